@@ -6,63 +6,296 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/anknetau/orto/orto"
 	"github.com/anknetau/orto/util"
 )
 
-func printUsage(fs *flag.FlagSet) {
+// command is a subcommand, eg "orto save". setup defines its flags, and returns what runs it with the remaining
+// arguments once they are parsed, returning the exit code.
+type command struct {
+	name        string
+	arguments   string
+	description string
+	minArgs     int
+	maxArgs     int
+	runsGit     bool // Only the commands that run git accept -PathToGitBinary
+	setup       func(flagSet *flag.FlagSet, globals *globalFlags) func(args []string) int
+}
+
+// globalFlags are accepted by every command, except for pathToGitBinary, see command.runsGit.
+type globalFlags struct {
+	pathToGitBinary string
+	verbose         bool
+	quiet           bool
+}
+
+// passphraseVariable is the environment variable with the passphrase that change sets are encrypted with. It is not a
+// flag, so that it doesn't show in the list of processes.
+const passphraseVariable = "ORTO_PASSPHRASE"
+
+var commands = []command{
+	{"save", "<input_dir> [output]", "Save the changes in a git working tree as a change set", 1, 2, true, setupSave},
+	{"restore", "<change_set> <dest_dir>", "Restore a change set onto a git working tree", 2, 2, true, setupRestore},
+	{"list", "<store>", "List the change sets in a directory", 1, 1, false, setupList},
+	{"show", "<change_set>", "Show what a change set contains", 1, 1, false, setupShow},
+	{"diff", "<change_set>", "Print the changes in a change set as a patch", 1, 1, false, setupDiff},
+	{"verify", "<change_set>", "Check that a change set has every file it refers to, with the right content", 1, 1, false, setupVerify},
+}
+
+func printUsage() {
 	util.ErrPrintLnf("orto v%s usage:\n", orto.Version())
-	util.ErrPrintLnf("orto [flags] <input_dir> <output_dir>\n")
-	util.ErrPrintLnf("input_dir is a directory or subdirectory of a git working tree. Orto will use the root of the repository as input")
-	util.ErrPrintLnf("output_dir is the output directory")
+	util.ErrPrintLnf("orto <command> [flags] <arguments>\n")
+	util.ErrPrintLnf("Commands are:\n")
+	for _, c := range commands {
+		util.ErrPrintLnf("  %-34s %s", c.name+" "+c.arguments, c.description)
+	}
 	util.ErrPrintLnf("")
+	util.ErrPrintLnf("Run 'orto <command> -help' for the flags of a command\n")
+	util.ErrPrintLnf("Settings are also read from %s at the root of the worktree, and from %s\n", orto.RepoConfigFileName, orto.UserConfigFile())
+}
+
+func printCommandUsage(c command, fs *flag.FlagSet) {
+	util.ErrPrintLnf("orto v%s usage:\n", orto.Version())
+	util.ErrPrintLnf("orto %s [flags] %s\n", c.name, c.arguments)
+	util.ErrPrintLnf("%s\n", c.description)
 	util.ErrPrintLnf("Flags are:\n")
 	util.ErrPrintLnf("  -help: show help")
 	fs.SetOutput(os.Stderr)
 	fs.PrintDefaults()
-	flag.PrintDefaults()
 	util.ErrPrintLnf("")
 	util.ErrPrintLnf("Flags can be passed with one or two dashes: -x and --x are equivalent\n")
 }
 
-var (
-	ErrFatal = errors.New("oh noes")
-)
+// Run runs the command in args, which don't include the name of the program, and returns the exit code: 0 on
+// success or after showing help, 1 when the command fails and 2 if the command line is invalid.
+func Run(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+	switch args[0] {
+	case "help", "-help", "--help", "-h", "--h":
+		printUsage()
+		return 0
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return runCommand(c, args[1:])
+		}
+	}
+	return usageError("unknown command '"+args[0]+"'", "orto -help")
+}
 
-func ParseOrExit() orto.UserParameters {
-	result := orto.UserParameters{}
-	flagSet := flag.NewFlagSet("orto", flag.ContinueOnError)
+func runCommand(c command, args []string) int {
+	flagSet := flag.NewFlagSet("orto "+c.name, flag.ContinueOnError)
 	flagSet.SetOutput(io.Discard)
 	flagSet.Usage = func() {}
-	now := util.SerializedDateTime(time.Now())
-	flagSet.StringVar(&result.ChangeSetName, "ChangeSetName", "", "ChangeSetName to use. Default: current datetime (eg '"+now+"')")
-
-	err := flagSet.Parse(os.Args[1:])
+	var globals globalFlags
+	if c.runsGit {
+		flagSet.StringVar(&globals.pathToGitBinary, "PathToGitBinary", "", "git executable to use. Default: as configured, or 'git' from the PATH")
+	}
+	flagSet.BoolVar(&globals.verbose, "Verbose", false, "Log more, including what git reports")
+	flagSet.BoolVar(&globals.quiet, "Quiet", false, "Only log errors")
+	run := c.setup(flagSet, &globals)
 
+	err := flagSet.Parse(args)
 	if errors.Is(err, flag.ErrHelp) {
-		printUsage(flagSet)
-		os.Exit(2)
+		printCommandUsage(c, flagSet)
+		return 0
 	}
+	help := "orto " + c.name + " -help"
 	if err != nil {
-		usageFatal(err)
-		os.Exit(2)
+		return usageError(err.Error(), help)
+	}
+	if flagSet.NArg() < c.minArgs || flagSet.NArg() > c.maxArgs {
+		return usageError(fmt.Sprintf("expected %s, got %d arguments", c.arguments, flagSet.NArg()), help)
+	}
+	if globals.verbose && globals.quiet {
+		return usageError("-Verbose and -Quiet can't be used together", help)
+	}
+	if globals.verbose {
+		orto.SetVerbosity(orto.VerbosityVerbose)
+	} else if globals.quiet {
+		orto.SetVerbosity(orto.VerbosityQuiet)
+	}
+	return run(flagSet.Args())
+}
+
+func setupSave(flagSet *flag.FlagSet, globals *globalFlags) func(args []string) int {
+	params := orto.UserParameters{}
+	now := util.SerializedDateTime(time.Now())
+	flagSet.StringVar(&params.ChangeSetName, "ChangeSetName", "", "ChangeSetName to use. Default: current datetime (eg '"+now+"')")
+	optionalBoolFlag(flagSet, "CopyDotGit", "Copy the contents of .git too", &params.Config.CopyDotGit)
+	optionalBoolFlag(flagSet, "CopyGitIgnoredFiles", "Copy files that git ignores too", &params.Config.CopyGitIgnoredFiles)
+	optionalBoolFlag(flagSet, "CopyUnchangedFiles", "Copy files that have not changed too", &params.Config.CopyUnchangedFiles)
+	addPatternFlag(flagSet, "Ignore", "Never save the paths that match this pattern, as in .ortoignore, eg 'vendor/'. Can be repeated", orto.ValidPathRule, &params.Ignore)
+	addPatternFlag(flagSet, "Include", "Only save the paths that match this pattern, as in .ortoignore. Can be repeated", orto.ValidPathRule, &params.Include)
+	addPatternFlag(flagSet, "GitIgnoredInclude", "Only copy the files git ignores that match this pattern, eg '.env*'. Can be repeated", orto.ValidPathRule, &params.GitIgnoredInclude)
+	addPatternFlag(flagSet, "GitIgnoredExclude", "Never copy the files git ignores that match this pattern, besides eg 'node_modules/'. Can be repeated", orto.ValidPathRule, &params.GitIgnoredExclude)
+	flagSet.Int64Var(&params.GitIgnoredMaxSize, "GitIgnoredMaxSize", 0, "The largest file git ignores to copy, in bytes. Default: "+strconv.Itoa(orto.DefaultGitIgnoredMaxSize))
+	flagSet.Func("Encrypt", "Which files to encrypt, one of none, untracked (added and ignored files) or all. Default: none, or as configured", func(s string) error {
+		scope := orto.EncryptScope(s)
+		if !scope.IsValid() {
+			return fmt.Errorf("unknown encryption '%s'", s)
+		}
+		params.Encrypt = scope
+		return nil
+	})
+	flagSet.Func("Recipient", "age public key to encrypt for, eg 'age1...'. Can be repeated", func(s string) error {
+		params.Recipients = append(params.Recipients, s)
+		return nil
+	})
+	flagSet.Func("Secrets", "What to do with files that look like they hold secrets, one of off, report, refuse (stop saving) or encrypt. Default: report, or as configured", func(s string) error {
+		action := orto.SecretAction(s)
+		if !action.IsValid() {
+			return fmt.Errorf("unknown secrets action '%s'", s)
+		}
+		params.Secrets = action
+		return nil
+	})
+	usePassphrase := flagSet.Bool("Passphrase", false, "Encrypt with the passphrase in $"+passphraseVariable+" instead of recipients")
+	flagSet.IntVar(&params.Concurrency, "Concurrency", 0, "How many files to hash at once. Default: the number of CPUs")
+	flagSet.StringVar(&params.BaseRevision, "BaseRevision", "", "Revision to compare the worktree with, eg 'origin/main' or a tag. Default: HEAD")
+	flagSet.BoolVar(&params.Paranoid, "Paranoid", false, "Hash every file, instead of trusting git's index for those it says are clean")
+	flagSet.Func("Format", "Output format, one of "+formatList()+". Default: inferred from output, eg 'out.zip' is a zip, then configured", func(s string) error {
+		format := orto.OutputFormat(s)
+		if !format.IsRegistered() {
+			return fmt.Errorf("unknown format '%s'", s)
+		}
+		params.Format = format
+		return nil
+	})
+	return func(args []string) int {
+		params.Source = args[0]
+		if len(args) > 1 {
+			params.Destination = args[1]
+		}
+		params.PathToGitBinary = globals.pathToGitBinary
+		if *usePassphrase {
+			params.Passphrase = os.Getenv(passphraseVariable)
+			if params.Passphrase == "" {
+				return usageError("-Passphrase needs $"+passphraseVariable, "orto save -help")
+			}
+		}
+		orto.Run(params)
+		return 0
+	}
+}
+
+func setupRestore(flagSet *flag.FlagSet, globals *globalFlags) func(args []string) int {
+	params := orto.RestoreParameters{}
+	flagSet.BoolVar(&params.RestoreDotGit, "RestoreDotGit", false, "Restore the contents of .git too, if they were saved")
+	flagSet.BoolVar(&params.IgnoreHeadMismatch, "IgnoreHeadMismatch", false, "Restore even if HEAD is not where the change set was taken")
+	flagSet.BoolVar(&params.ThreeWayMerge, "ThreeWayMerge", false, "Merge into files that changed since the change set was taken, rather than refusing")
+	flagSet.BoolVar(&params.RestoreIndex, "RestoreIndex", false, "Also stage what was staged when the change set was taken")
+	flagSet.BoolVar(&params.DryRun, "DryRun", false, "Only list what would be restored")
+	addFilterFlags(flagSet, &params.Filter)
+	addIdentityFlag(flagSet, &params.IdentityFiles)
+	return func(args []string) int {
+		params.ChangeSet = args[0]
+		params.Destination = args[1]
+		params.PathToGitBinary = globals.pathToGitBinary
+		params.Passphrase = os.Getenv(passphraseVariable)
+		orto.Restore(params)
+		return 0
+	}
+}
+
+func setupList(*flag.FlagSet, *globalFlags) func(args []string) int {
+	return func(args []string) int {
+		orto.List(args[0])
+		return 0
+	}
+}
+
+func setupShow(*flag.FlagSet, *globalFlags) func(args []string) int {
+	return func(args []string) int {
+		orto.Show(args[0])
+		return 0
+	}
+}
+
+func setupDiff(flagSet *flag.FlagSet, _ *globalFlags) func(args []string) int {
+	var filter orto.ChangeFilter
+	var identityFiles []string
+	addFilterFlags(flagSet, &filter)
+	addIdentityFlag(flagSet, &identityFiles)
+	return func(args []string) int {
+		orto.Diff(args[0], filter, orto.ReadIdentities(identityFiles, os.Getenv(passphraseVariable)))
+		return 0
 	}
+}
+
+func setupVerify(flagSet *flag.FlagSet, _ *globalFlags) func(args []string) int {
+	var identityFiles []string
+	addIdentityFlag(flagSet, &identityFiles)
+	return func(args []string) int {
+		if orto.Verify(args[0], orto.ReadIdentities(identityFiles, os.Getenv(passphraseVariable))) > 0 {
+			return 1
+		}
+		return 0
+	}
+}
+
+// addFilterFlags adds repeatable flags that select changes by path and kind.
+func addFilterFlags(flagSet *flag.FlagSet, filter *orto.ChangeFilter) {
+	addPatternFlag(flagSet, "Include", "Only the changes whose paths match this pattern, as in .ortoignore. Can be repeated", orto.ValidPathRule, &filter.Include)
+	addPatternFlag(flagSet, "Exclude", "Not the changes whose paths match this pattern, as in .ortoignore. Can be repeated", orto.ValidPathRule, &filter.Exclude)
+	flagSet.Func("Kind", "Only the changes of this kind, eg 'Added'. Can be repeated", func(s string) error {
+		kind, ok := orto.ParseChangeKind(s)
+		if !ok {
+			return fmt.Errorf("unknown kind '%s'", s)
+		}
+		filter.Kinds = append(filter.Kinds, kind)
+		return nil
+	})
+}
+
+// addIdentityFlag adds a repeatable flag for the files with the keys that decrypt change sets. A passphrase can be
+// given in $ORTO_PASSPHRASE instead.
+func addIdentityFlag(flagSet *flag.FlagSet, identityFiles *[]string) {
+	flagSet.Func("Identity", "age identity file, with a private key that decrypts the change set. Can be repeated. A passphrase is read from $"+passphraseVariable, func(s string) error {
+		*identityFiles = append(*identityFiles, s)
+		return nil
+	})
+}
+
+func addPatternFlag(flagSet *flag.FlagSet, name string, usage string, valid func(string) bool, patterns *[]string) {
+	flagSet.Func(name, usage, func(s string) error {
+		if !valid(s) {
+			return fmt.Errorf("invalid path pattern '%s'", s)
+		}
+		*patterns = append(*patterns, s)
+		return nil
+	})
+}
+
+// optionalBoolFlag adds a bool flag that is only set when it is given, so that both -x and -x=false override the
+// configuration files.
+func optionalBoolFlag(flagSet *flag.FlagSet, name string, usage string, value **bool) {
+	flagSet.BoolFunc(name, usage, func(s string) error {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*value = &b
+		return nil
+	})
+}
 
-	//fmt.fprintln(, "n =", *nFlag)
-	if len(flagSet.Args()) != 2 {
-		usageFatal("Invalid number of arguments. See 'orto -h'")
+func formatList() string {
+	var names []string
+	for _, format := range orto.OutputFormats() {
+		names = append(names, string(format))
 	}
-	println("starting...")
-	util.Debug(flagSet.Args())
-	//input := flagSet.Args()[0]
-	//output := flagSet.Args()[1]
-	return result
+	return strings.Join(names, ", ")
 }
 
-func usageFatal(message ...any) {
-	_, _ = fmt.Fprint(os.Stderr, message...)
-	_, _ = fmt.Fprint(os.Stderr, "\n")
-	os.Exit(2)
+func usageError(message string, help string) int {
+	_, _ = fmt.Fprintf(os.Stderr, "orto: %s\nSee '%s'\n", message, help)
+	return 2
 }
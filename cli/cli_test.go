@@ -0,0 +1,79 @@
+package cli_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/cli"
+)
+
+func TestRunExitCodes(t *testing.T) {
+	assert.Equal(t, 2, cli.Run(nil))
+	assert.Equal(t, 0, cli.Run([]string{"-help"}))
+	assert.Equal(t, 2, cli.Run([]string{"unknown"}))
+	assert.Equal(t, 0, cli.Run([]string{"save", "-help"}))
+	assert.Equal(t, 2, cli.Run([]string{"save", "in", "out", "extra_argument"}))
+	assert.Equal(t, 2, cli.Run([]string{"save", "-Format", "rar", "in", "out"}))
+	assert.Equal(t, 2, cli.Run([]string{"show", "-Verbose", "-Quiet", "change_set"}))
+	assert.Equal(t, 2, cli.Run([]string{"diff", "-Include", "../outside", "change_set"}))
+	// Only save and restore run git
+	assert.Equal(t, 2, cli.Run([]string{"verify", "-PathToGitBinary", "/usr/bin/git", "change_set"}))
+	assert.Equal(t, 0, cli.Run([]string{"restore", "-PathToGitBinary", "/usr/bin/git", "-help"}))
+}
+
+// runCapturingStderr runs the command in args, and returns its exit code and what it wrote to stderr.
+func runCapturingStderr(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "stderr")
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	stderr := os.Stderr
+	os.Stderr = f
+	code := cli.Run(args)
+	os.Stderr = stderr
+	out, err := os.ReadFile(f.Name())
+	assert.Equal(t, nil, err)
+	return code, string(out)
+}
+
+func TestRunMessages(t *testing.T) {
+	t.Setenv("ORTO_PASSPHRASE", "")
+	code, out := runCapturingStderr(t, "-help")
+	assert.Equal(t, 0, code)
+	for _, command := range []string{"save", "restore", "list", "show", "diff", "verify"} {
+		assert.True(t, strings.Contains(out, "\n  "+command+" "), command+": "+out)
+	}
+
+	// Each flag is listed once
+	code, out = runCapturingStderr(t, "save", "-help")
+	assert.Equal(t, 0, code)
+	assert.True(t, strings.HasPrefix(out, "orto v"), out)
+	listed := make(map[string]int)
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+			listed[fields[0]]++
+		}
+	}
+	for _, flag := range []string{"-ChangeSetName", "-CopyDotGit", "-CopyGitIgnoredFiles", "-CopyUnchangedFiles", "-PathToGitBinary", "-BaseRevision"} {
+		assert.Equal(t, 1, listed[flag], flag+": "+out)
+	}
+
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"unknown"}, "orto: unknown command 'unknown'\nSee 'orto -help'\n"},
+		{[]string{"save"}, "orto: expected <input_dir> [output], got 0 arguments\nSee 'orto save -help'\n"},
+		{[]string{"save", "-Unknown", "in"}, "orto: flag provided but not defined: -Unknown\nSee 'orto save -help'\n"},
+		{[]string{"save", "-Verbose", "-Quiet", "in"}, "orto: -Verbose and -Quiet can't be used together\nSee 'orto save -help'\n"},
+		{[]string{"save", "-Encrypt", "some", "in"}, "orto: invalid value \"some\" for flag -Encrypt: unknown encryption 'some'\nSee 'orto save -help'\n"},
+		{[]string{"save", "-Passphrase", "in", "out"}, "orto: -Passphrase needs $ORTO_PASSPHRASE\nSee 'orto save -help'\n"},
+		{[]string{"restore", "change_set"}, "orto: expected <change_set> <dest_dir>, got 1 arguments\nSee 'orto restore -help'\n"},
+	} {
+		code, out = runCapturingStderr(t, test.args...)
+		assert.Equal(t, 2, code, strings.Join(test.args, " "))
+		assert.Equal(t, test.message, out, strings.Join(test.args, " "))
+	}
+}
@@ -1,6 +1,7 @@
 package fp
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const SHA1LEN = 40
@@ -31,29 +33,65 @@ func NewChecksum(checksum string) Checksum {
 }
 
 func InternalChecksumBlob(path string, algo Algo) Checksum {
-	// TODO: os.Stat follows symlinks apparently
-	fileInfo, err := os.Stat(path)
+	checksum, _, err := ChecksumBlobFile(path, algo)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return checksum
+}
+
+// ChecksumBlobFile calculates the checksum git gives the file at path when none of its filters apply. A symlink is
+// hashed as its target, as git stores it. It also reports whether the content has a carriage return, which is what
+// the line ending filters would change.
+func ChecksumBlobFile(path string, algo Algo) (Checksum, bool, error) {
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		return "", false, err
+	}
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", false, err
+		}
+		return ChecksumObject("blob", []byte(target), algo), false, nil
+	}
 
 	fileToRead, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return "", false, err
 	}
 	defer fileToRead.Close()
+	// The size has to come from the file that is read, in case it was replaced in the meantime
+	fileInfo, err = fileToRead.Stat()
+	if err != nil {
+		return "", false, err
+	}
 
-	var hashAlgo hash.Hash
-	hashAlgo = checksumGoHash(algo)
+	hashAlgo := NewHash(algo)
 	header := []byte("blob " + strconv.FormatInt(fileInfo.Size(), 10) + "\x00")
 	hashAlgo.Write(header)
-	if _, err := io.Copy(hashAlgo, fileToRead); err != nil {
-		log.Fatal(err)
+	scanner := &crScanner{w: hashAlgo}
+	if _, err := io.CopyN(scanner, fileToRead, fileInfo.Size()); err != nil {
+		return "", false, err
 	}
-	return Checksum(hex.EncodeToString(hashAlgo.Sum(nil)))
+	return Checksum(hex.EncodeToString(hashAlgo.Sum(nil))), scanner.found, nil
 }
 
-func checksumGoHash(algo Algo) hash.Hash {
+// crScanner passes everything through to w, noting any carriage returns.
+type crScanner struct {
+	w     io.Writer
+	found bool
+}
+
+func (s *crScanner) Write(p []byte) (int, error) {
+	if !s.found && bytes.IndexByte(p, '\r') >= 0 {
+		s.found = true
+	}
+	return s.w.Write(p)
+}
+
+// NewHash returns the hash function of the algorithm.
+func NewHash(algo Algo) hash.Hash {
 	switch algo {
 	case SHA1:
 		return sha1.New()
@@ -63,6 +101,14 @@ func checksumGoHash(algo Algo) hash.Hash {
 	panic("tried to use algorithm " + algo)
 }
 
+// ChecksumObject calculates the id that git gives an object of the given type, eg "blob", with the given content.
+func ChecksumObject(objectType string, content []byte, algo Algo) Checksum {
+	hashAlgo := NewHash(algo)
+	hashAlgo.Write([]byte(objectType + " " + strconv.Itoa(len(content)) + "\x00"))
+	hashAlgo.Write(content)
+	return Checksum(hex.EncodeToString(hashAlgo.Sum(nil)))
+}
+
 func AlgoOfGitHashValue(checksum string) Algo {
 	if len(checksum) == SHA1LEN {
 		return SHA1
@@ -87,3 +133,8 @@ func AlgoOfGitObjectFormat(format string) Algo {
 func (c Checksum) GetAlgo() Algo {
 	return AlgoOfGitHashValue(string(c))
 }
+
+// IsZero is true for the all-zeroes checksum git uses for missing objects.
+func (c Checksum) IsZero() bool {
+	return len(c) > 0 && strings.Trim(string(c), "0") == ""
+}
@@ -2,6 +2,7 @@ package fp_test
 
 import (
 	"log"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -168,3 +169,24 @@ func TestSplitFilePath_ExpectedShapes(t *testing.T) {
 		assert.Equal(t, tt.want, got)
 	}
 }
+
+func TestChecksumBlobFile(t *testing.T) {
+	dir := t.TempDir()
+	test := func(name string, content string, expected fp.Checksum, expectedCR bool) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		assert.Equal(t, nil, os.WriteFile(path, []byte(content), 0644))
+		checksum, hasCR, err := fp.ChecksumBlobFile(path, fp.SHA1)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, expected, checksum, name)
+		assert.Equal(t, expectedCR, hasCR, name)
+	}
+	test("lf", "a\n", "78981922613b2afb6025042ff6bd878ac1994e85", false)
+	test("crlf", "a\r\n", "533790e525dfeb785a02edfceeb1c7d120972c0d", true)
+
+	// A symlink is hashed as its target
+	assert.Equal(t, nil, os.Symlink("lf", filepath.Join(dir, "link")))
+	checksum, _, err := fp.ChecksumBlobFile(filepath.Join(dir, "link"), fp.SHA1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, fp.ChecksumObject("blob", []byte("lf"), fp.SHA1), checksum)
+}
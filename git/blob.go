@@ -2,7 +2,9 @@ package git
 
 import (
 	"log"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/anknetau/orto/fp"
@@ -23,6 +25,7 @@ type Blob struct {
 	Path      string // relative path as returned by git
 	Checksum  fp.Checksum
 	Mode      Mode
+	Size      int64
 }
 
 type Mode string
@@ -52,6 +55,29 @@ const (
 	ObjectTypeCommit = "commit"
 )
 
+// ModeOfFileMode returns the mode git would record for a file with the given file system mode.
+func ModeOfFileMode(fileMode os.FileMode) Mode {
+	if fileMode&os.ModeSymlink != 0 {
+		return ModeSymlink
+	}
+	if fileMode&0111 != 0 {
+		return ModeExecutable
+	}
+	return ModeFile
+}
+
+// FileMode is the inverse of ModeOfFileMode, for files checked out from git.
+func (mode Mode) FileMode() os.FileMode {
+	switch mode {
+	case ModeExecutable:
+		return 0755
+	case ModeSymlink:
+		return os.ModeSymlink | 0777
+	default:
+		return 0644
+	}
+}
+
 func IsValidGitMode(mode string) bool {
 	m := Mode(mode)
 	return m == ModeDirectory || m == ModeFile || m == ModeExecutable ||
@@ -61,14 +87,14 @@ func IsValidGitMode(mode string) bool {
 func IsSupportedGitMode(mode string) bool {
 	m := Mode(mode)
 	// TODO: will we ever need Directory? Probably not because we are looking just for files.
-	return m == ModeFile || m == ModeExecutable || m == ModeDeleted || m == ModeSubmodule
+	return m == ModeFile || m == ModeExecutable || m == ModeSymlink || m == ModeDeleted || m == ModeSubmodule
 }
 
 // Returns either Blob or Submodule, but never both.
 func parseGetTreeLine(line string) (*Blob, *Submodule) {
 	fields := strings.Split(line, "|>")
 	//fmt.Printf("fields: %#v\n", fields)
-	if len(fields) != 4 || len(fields[1]) == 0 || len(fields[2]) == 0 || len(fields[3]) == 0 {
+	if len(fields) != 5 || len(fields[1]) == 0 || len(fields[2]) == 0 || len(fields[3]) == 0 || len(fields[4]) == 0 {
 		log.Fatal("Invalid line from git: " + line)
 	}
 	objectType := fields[0]
@@ -76,10 +102,15 @@ func parseGetTreeLine(line string) (*Blob, *Submodule) {
 	path := fields[2]
 	mode := NewMode(fields[3])
 	if objectType == ObjectTypeCommit {
+		// Submodules have no size, it's always "-"
 		newSubmodule := NewSubmodule(objectType, path, checksum, mode)
 		return nil, &newSubmodule
 	} else if objectType == ObjectTypeBlob {
-		newBlob := NewBlob(objectType, path, checksum, mode)
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			log.Fatal("Invalid size from git: " + line)
+		}
+		newBlob := NewBlob(objectType, path, checksum, mode, size)
 		return &newBlob, nil
 	} else {
 		// When `git ls-tree` is passed -r, it will recurse and not show trees, but resolve the blobs within instead.
@@ -88,7 +119,7 @@ func parseGetTreeLine(line string) (*Blob, *Submodule) {
 	}
 }
 
-func NewBlob(objectType string, path string, checksum fp.Checksum, mode Mode) Blob {
+func NewBlob(objectType string, path string, checksum fp.Checksum, mode Mode, size int64) Blob {
 	if !filepath.IsLocal(path) {
 		log.Fatal("Git path is absolute or incorrect: " + path)
 	}
@@ -97,7 +128,7 @@ func NewBlob(objectType string, path string, checksum fp.Checksum, mode Mode) Bl
 		log.Fatal("Git object type is incorrect: " + objectType)
 	}
 	fp.ValidFilePathForOrtoOrDie(CleanPath)
-	return Blob{CleanPath, path, checksum, mode}
+	return Blob{CleanPath, path, checksum, mode, size}
 }
 
 func NewSubmodule(objectType string, path string, checksum fp.Checksum, mode Mode) Submodule {
@@ -0,0 +1,191 @@
+package git
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anknetau/orto/fp"
+)
+
+// ObjectInfo is the type and size of an object, as given by git cat-file.
+type ObjectInfo struct {
+	Checksum fp.Checksum
+	Type     string
+	Size     int64
+}
+
+// CatFile is a long-lived git cat-file process, which reads objects one at a time: their content with --batch, or
+// only their type and size with --batch-check.
+type CatFile struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	br      *bufio.Reader
+	mu      sync.Mutex // serialize write->read pairs
+	content bool
+}
+
+// catFiles are the processes of an Env, started when first needed and shared by its copies.
+type catFiles struct {
+	mu    sync.Mutex
+	batch *CatFile
+	check *CatFile
+}
+
+// NewCatFile launches git cat-file, with --batch if content is true, otherwise with --batch-check.
+// Don't forget to call Close() when done!
+func NewCatFile(pathToGitBinary string, content bool) (*CatFile, error) {
+	mode := "--batch-check"
+	if content {
+		mode = "--batch"
+	}
+	cmd := exec.Command(pathToGitBinary, "cat-file", mode)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		_ = stdin.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		_ = stdin.Close()
+		return nil, err
+	}
+	return &CatFile{cmd: cmd, stdin: stdin, br: bufio.NewReader(stdout), content: content}, nil
+}
+
+func (c *CatFile) request(checksum fp.Checksum) (ObjectInfo, error) {
+	if _, err := io.WriteString(c.stdin, string(checksum)+"\n"); err != nil {
+		return ObjectInfo{}, err
+	}
+	// "<checksum> <type> <size>", or "<checksum> missing"
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 2 && fields[1] == "missing" {
+		log.Fatal("Object not found: " + string(checksum))
+	}
+	if len(fields) != 3 {
+		log.Fatal("Could not parse git output: " + line)
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		log.Fatal("Could not parse git output: " + line)
+	}
+	return ObjectInfo{Checksum: fp.NewChecksum(fields[0]), Type: fields[1], Size: size}, nil
+}
+
+// Info returns the type and size of an object.
+func (c *CatFile) Info(checksum fp.Checksum) (ObjectInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.content {
+		panic("Illegal state: Info needs --batch-check")
+	}
+	return c.request(checksum)
+}
+
+// Stream writes the content of an object to w, without holding it in memory, and returns its type and size.
+func (c *CatFile) Stream(checksum fp.Checksum, w io.Writer) (ObjectInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.content {
+		panic("Illegal state: Stream needs --batch")
+	}
+	info, err := c.request(checksum)
+	if err != nil {
+		return info, err
+	}
+	// The content is followed by a newline, which is read even if w fails, to keep the process in step
+	content := io.LimitReader(c.br, info.Size)
+	n, err := io.Copy(w, content)
+	if err == nil && n < info.Size {
+		return info, io.ErrUnexpectedEOF
+	} else if err != nil {
+		// Whatever w didn't take
+		if _, readErr := io.Copy(io.Discard, content); readErr != nil {
+			return info, readErr
+		}
+	}
+	if _, readErr := c.br.Discard(1); readErr != nil {
+		return info, readErr
+	}
+	return info, err
+}
+
+// Close closes the process
+func (c *CatFile) Close() error {
+	_ = c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+func (env Env) catFile(content bool) *CatFile {
+	if env.catFiles == nil {
+		panic("Illegal state: Env not created by Find")
+	}
+	env.catFiles.mu.Lock()
+	defer env.catFiles.mu.Unlock()
+	current := &env.catFiles.check
+	if content {
+		current = &env.catFiles.batch
+	}
+	if *current == nil {
+		catFile, err := NewCatFile(env.PathToBinary, content)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*current = catFile
+	}
+	return *current
+}
+
+// RunStreamRawContent writes the content of a blob to w, without holding it in memory.
+func (env Env) RunStreamRawContent(checksum fp.Checksum, w io.Writer) {
+	info, err := env.catFile(true).Stream(checksum, w)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info.Type != ObjectTypeBlob {
+		log.Fatal("Not a blob: " + string(checksum))
+	}
+}
+
+// RunGetObjectInfo returns the type and size of an object, without reading its content.
+func (env Env) RunGetObjectInfo(checksum fp.Checksum) ObjectInfo {
+	info, err := env.catFile(false).Info(checksum)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return info
+}
+
+// RunGetObjectSize returns the size in bytes of an object's content.
+func (env Env) RunGetObjectSize(checksum fp.Checksum) int64 {
+	return env.RunGetObjectInfo(checksum).Size
+}
+
+// Close stops the processes that were started for env.
+func (env Env) Close() error {
+	if env.catFiles == nil {
+		return nil
+	}
+	env.catFiles.mu.Lock()
+	defer env.catFiles.mu.Unlock()
+	var errs []error
+	for _, catFile := range []**CatFile{&env.catFiles.batch, &env.catFiles.check} {
+		if *catFile != nil {
+			errs = append(errs, (*catFile).Close())
+			*catFile = nil
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -77,10 +77,35 @@ func (env Env) RunGetGitDir() string {
 	return strings.TrimSpace(out)
 }
 
+// RunResolveCommit returns the commit that a revision, eg a branch, tag or "HEAD~2", points to, if it exists.
+func (env Env) RunResolveCommit(revision string) (fp.Checksum, bool) {
+	out, err := runToString(env.PathToBinary, "rev-parse", "--verify", "--quiet", "--end-of-options", revision+"^{commit}")
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return "", false
+		}
+		log.Fatal(err)
+	}
+	return fp.NewChecksum(strings.TrimSpace(out)), true
+}
+
+// RunGetHead returns the commit that HEAD currently points to.
+func (env Env) RunGetHead() fp.Checksum {
+	out, err := runToString(env.PathToBinary, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return fp.NewChecksum(strings.TrimSpace(out))
+}
+
 // NewHasher launches a long-lived git hash-object process.
 // Don't forget to call Close() when done!
 func NewHasher(pathToGitBinary string) (*Hasher, error) {
-	cmd := exec.Command(pathToGitBinary, "hash-object", "--stdin-paths")
+	return startHasher(exec.Command(pathToGitBinary, "hash-object", "--stdin-paths"))
+}
+
+func startHasher(cmd *exec.Cmd) (*Hasher, error) {
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, err
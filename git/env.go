@@ -14,6 +14,7 @@ type Env struct {
 	Algo         fp.Algo
 	AbsRoot      string
 	AbsGitDir    string
+	catFiles     *catFiles
 }
 
 func Find(pathToBinary string, absPathToChdir string) Env {
@@ -32,6 +33,7 @@ func Find(pathToBinary string, absPathToChdir string) Env {
 		PathToBinary: pathToBinary,
 		Version:      version,
 		Algo:         fp.UNKNOWN,
+		catFiles:     &catFiles{},
 	}
 
 	worktreeStatus := env.RunGetIsInsideWorktree()
@@ -1,34 +1,50 @@
 package git
 
 import (
+	"bufio"
+	"io"
+	"iter"
 	"log"
 	"os/exec"
 	"strings"
-)
 
-func RunGetTreeForHead(gitEnv Env) ([]Blob, []Submodule) {
-	// %(objectmode) %(objecttype) %(objectname)%x09%(path)
-	cmd := exec.Command(gitEnv.PathToBinary, "ls-tree", "HEAD", "-r", "--format=%(objecttype)|>%(objectname)|>%(path)|>%(objectmode)", "-z")
-	out, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
-	}
-	var blobs []Blob
-	var submodules []Submodule
-	output := strings.TrimRight(string(out), "\x00")
-	lines := strings.SplitSeq(output, "\x00")
+	"github.com/anknetau/orto/fp"
+)
 
-	for line := range lines {
-		pBlob, pSubmodule := parseGetTreeLine(line)
-		if pBlob == nil && pSubmodule == nil {
-			log.Fatal("Invalid line from git: " + line)
+// RunStreamTree yields the blobs and submodules in a commit, one of the two being nil, in git's order: sorted byte by
+// byte by path, with "/" as the separator.
+func RunStreamTree(gitEnv Env, commit fp.Checksum) iter.Seq2[*Blob, *Submodule] {
+	return func(yield func(*Blob, *Submodule) bool) {
+		// %(objectmode) %(objecttype) %(objectname)%x09%(path)
+		cmd := exec.Command(gitEnv.PathToBinary, "ls-tree", string(commit), "-r", "--format=%(objecttype)|>%(objectname)|>%(path)|>%(objectmode)|>%(objectsize)", "-z")
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Fatal(err)
 		}
-		if pBlob != nil {
-			blobs = append(blobs, *pBlob)
-		} else {
-			submodules = append(submodules, *pSubmodule)
+		if err := cmd.Start(); err != nil {
+			log.Fatal(err)
+		}
+		br := bufio.NewReader(stdout)
+		for {
+			line, err := br.ReadString(0)
+			if err == io.EOF && line == "" {
+				break
+			} else if err != nil && err != io.EOF {
+				log.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\x00")
+			pBlob, pSubmodule := parseGetTreeLine(line)
+			if pBlob == nil && pSubmodule == nil {
+				log.Fatal("Invalid line from git: " + line)
+			}
+			if !yield(pBlob, pSubmodule) {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+				return
+			}
+		}
+		if err := cmd.Wait(); err != nil {
+			log.Fatal(err)
 		}
 	}
-
-	return blobs, submodules
 }
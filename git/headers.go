@@ -0,0 +1,83 @@
+package git
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/anknetau/orto/fp"
+)
+
+// StatusHeaders are the typed contents of the comment lines that `git status --porcelain=v2 --branch --show-stash`
+// prints before the changes:
+//
+//	# branch.oid <commit> | (initial)
+//	# branch.head <branch> | (detached)
+//	# branch.upstream <upstream-branch>
+//	# branch.ab +<ahead> -<behind>
+//	# stash <count>
+type StatusHeaders struct {
+	Oid             fp.Checksum // Empty when there are no commits yet
+	Head            string      // Empty when detached
+	Detached        bool
+	Upstream        string // Empty when there's no upstream
+	HasAheadBehind  bool   // False when there's no upstream, or the upstream is gone
+	Ahead           int
+	Behind          int
+	StashCount      int
+	UnknownComments []string
+}
+
+var (
+	reBranchAb = regexp.MustCompile(`^\+(\d+) -(\d+)$`)
+)
+
+func NewStatusHeaders(lines []StatusLine) StatusHeaders {
+	var headers StatusHeaders
+	for _, line := range lines {
+		if comment, ok := line.(CommentStatusLine); ok {
+			headers.parse(comment.Comment)
+		}
+	}
+	return headers
+}
+
+// parse takes a comment without its leading '#', eg " branch.head master".
+func (headers *StatusHeaders) parse(comment string) {
+	key, value, _ := strings.Cut(strings.TrimPrefix(comment, " "), " ")
+	switch key {
+	case "branch.oid":
+		if value != "(initial)" {
+			headers.Oid = fp.NewChecksum(value)
+		}
+	case "branch.head":
+		if value == "(detached)" {
+			headers.Detached = true
+		} else {
+			headers.Head = value
+		}
+	case "branch.upstream":
+		headers.Upstream = value
+	case "branch.ab":
+		matches := reBranchAb.FindStringSubmatch(value)
+		if matches == nil {
+			log.Fatal("Error parsing status header: " + comment)
+		}
+		headers.HasAheadBehind = true
+		headers.Ahead = atoiOrDie(matches[1], comment)
+		headers.Behind = atoiOrDie(matches[2], comment)
+	case "stash":
+		headers.StashCount = atoiOrDie(value, comment)
+	default:
+		headers.UnknownComments = append(headers.UnknownComments, comment)
+	}
+}
+
+func atoiOrDie(s string, line string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatal("Error parsing status header: " + line)
+	}
+	return n
+}
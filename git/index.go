@@ -0,0 +1,112 @@
+package git
+
+import (
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/anknetau/orto/fp"
+)
+
+// IndexChange is a path whose staged version in the index differs from HEAD.
+type IndexChange struct {
+	Path     string
+	OrigPath string // For a rename or copy, where the content came from
+	Status   Status
+	Mode     Mode // ModeDeleted when the path was removed from the index
+	Checksum fp.Checksum
+}
+
+func (change IndexChange) IsDeleted() bool {
+	return change.Mode == ModeDeleted
+}
+
+// IndexChanges returns the staged changes from the output of RunStatus. A rename is returned as the new path being
+// added and the original path being deleted.
+// TODO: unmerged entries are not included
+func IndexChanges(lines []StatusLine) []IndexChange {
+	var result []IndexChange
+	for _, line := range lines {
+		switch v := line.(type) {
+		case ChangedStatusLine:
+			// Intent-to-add entries have no blob yet
+			if isStaged(v.Status) && (v.ModeIndex == ModeDeleted || !v.ChecksumIndex.IsZero()) {
+				result = append(result, IndexChange{Path: v.Path, Status: v.Status, Mode: v.ModeIndex, Checksum: v.ChecksumIndex})
+			}
+		case RenamedOrCopiedStatusLine:
+			if isStaged(v.Change.Status) {
+				result = append(result, IndexChange{Path: v.Change.Path, OrigPath: v.OrigPath, Status: v.Change.Status, Mode: v.Change.ModeIndex, Checksum: v.Change.ChecksumIndex})
+				if v.Change.Status[0] == 'R' {
+					result = append(result, IndexChange{Path: v.OrigPath, Status: v.Change.Status, Mode: ModeDeleted})
+				}
+			}
+		}
+	}
+	return result
+}
+
+func isStaged(status Status) bool {
+	return status[0] != '.'
+}
+
+// RunWriteBlob stores the exact contents of a file in the object database, without applying any filters.
+func (env Env) RunWriteBlob(content io.Reader) fp.Checksum {
+	cmd := exec.Command(env.PathToBinary, "hash-object", "-w", "--no-filters", "--stdin")
+	cmd.Stdin = content
+	out, err := cmd.Output()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return fp.NewChecksum(strings.TrimSpace(string(out)))
+}
+
+// RunUpdateIndex stages the given blob at path, without touching the worktree.
+func (env Env) RunUpdateIndex(mode Mode, checksum fp.Checksum, path string) {
+	cmd := exec.Command(env.PathToBinary, "update-index", "--add", "--cacheinfo", string(mode)+","+string(checksum)+","+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Fatalf("Cannot stage %s: %s %s", path, err, out)
+	}
+}
+
+// RunRemoveFromIndex unstages path, without touching the worktree.
+func (env Env) RunRemoveFromIndex(path string) {
+	cmd := exec.Command(env.PathToBinary, "update-index", "--force-remove", "--", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Fatalf("Cannot unstage %s: %s %s", path, err, out)
+	}
+}
+
+// StatusPaths is what the output of RunStatus says about paths in the worktree, which git works out from the stat
+// information in the index rather than by reading files. Tracked paths that git lists nowhere are the same in the
+// worktree, the index and HEAD. Files marked assume-unchanged or skip-worktree are never listed.
+type StatusPaths struct {
+	Listed        map[string]bool        // Every path that is listed, in any way
+	MatchingIndex map[string]fp.Checksum // Listed paths whose worktree version is the same as the staged one
+}
+
+func NewStatusPaths(lines []StatusLine) StatusPaths {
+	result := StatusPaths{Listed: make(map[string]bool), MatchingIndex: make(map[string]fp.Checksum)}
+	addChanged := func(v ChangedStatusLine) {
+		result.Listed[v.Path] = true
+		if v.Status[1] == '.' && v.Sub[0] == 'N' && !v.ChecksumIndex.IsZero() {
+			result.MatchingIndex[v.Path] = v.ChecksumIndex
+		}
+	}
+	for _, line := range lines {
+		switch v := line.(type) {
+		case ChangedStatusLine:
+			addChanged(v)
+		case RenamedOrCopiedStatusLine:
+			addChanged(v.Change)
+			result.Listed[v.OrigPath] = true
+		case UnmergedStatusLine:
+			result.Listed[v.Path] = true
+		case UntrackedStatusLine:
+			result.Listed[v.Path] = true
+		case IgnoredStatusLine:
+			result.Listed[v.Path] = true
+		}
+	}
+	return result
+}
@@ -0,0 +1,23 @@
+package git
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// RunMergeFile does a three-way merge of the changes from base to other into current, using `git merge-file`.
+// None of the files are modified: the merged content is returned, along with the number of conflicts, which are
+// marked in the content in the usual way.
+func (env Env) RunMergeFile(current string, base string, other string, otherLabel string) ([]byte, int, error) {
+	cmd := exec.Command(env.PathToBinary, "merge-file", "-p", "-L", "current", "-L", "base", "-L", otherLabel, current, base, other)
+	out, err := cmd.Output()
+	if err == nil {
+		return out, 0, nil
+	}
+	var exitErr *exec.ExitError
+	// The exit code is the number of conflicts, capped at 127, or negative on error.
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 && exitErr.ExitCode() < 128 {
+		return out, exitErr.ExitCode(), nil
+	}
+	return nil, 0, err
+}
@@ -0,0 +1,210 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anknetau/orto/fp"
+)
+
+// Object is an object built natively, eg a tree or a commit, with its content.
+type Object struct {
+	Type     string
+	Checksum fp.Checksum
+	Content  []byte
+}
+
+func newObject(objectType string, content []byte, algo fp.Algo) Object {
+	return Object{Type: objectType, Checksum: fp.ChecksumObject(objectType, content, algo), Content: content}
+}
+
+// PackWriter writes the entries of a pack, each object once. The pack header has the number of objects, so it is
+// written separately at the end, by WriteBundle.
+type PackWriter struct {
+	w       io.Writer
+	written map[fp.Checksum]bool
+}
+
+func NewPackWriter(w io.Writer) *PackWriter {
+	return &PackWriter{w: w, written: make(map[fp.Checksum]bool)}
+}
+
+// Has is true if the object was already written.
+func (p *PackWriter) Has(checksum fp.Checksum) bool {
+	return p.written[checksum]
+}
+
+func (p *PackWriter) Count() int {
+	return len(p.written)
+}
+
+func packObjectType(objectType string) byte {
+	switch objectType {
+	case ObjectTypeCommit:
+		return 1
+	case ObjectTypeTree:
+		return 2
+	case ObjectTypeBlob:
+		return 3
+	}
+	panic("Unknown object type " + objectType)
+}
+
+// WriteObject writes an object of size bytes read from content, unless it was already written. The checksum is
+// trusted to match the content.
+func (p *PackWriter) WriteObject(checksum fp.Checksum, objectType string, size int64, content io.Reader) error {
+	if p.written[checksum] {
+		return nil
+	}
+	p.written[checksum] = true
+	// The type and size, with the size in little-endian groups of 7 bits after the first 4
+	header := []byte{packObjectType(objectType)<<4 | byte(size&0x0f)}
+	for rest := size >> 4; rest > 0; rest >>= 7 {
+		header[len(header)-1] |= 0x80
+		header = append(header, byte(rest&0x7f))
+	}
+	if _, err := p.w.Write(header); err != nil {
+		return err
+	}
+	zw := zlib.NewWriter(p.w)
+	if _, err := io.CopyN(zw, content, size); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Write writes an object built natively.
+func (p *PackWriter) Write(object Object) error {
+	return p.WriteObject(object.Checksum, object.Type, int64(len(object.Content)), bytes.NewReader(object.Content))
+}
+
+// BuildTrees builds the trees for the given entries natively, like RunWriteTree. The root tree is the last object.
+func BuildTrees(entries []TreeEntry, algo fp.Algo) []Object {
+	type node struct {
+		files map[string]TreeEntry
+		dirs  map[string]*node
+	}
+	newNode := func() *node {
+		return &node{files: make(map[string]TreeEntry), dirs: make(map[string]*node)}
+	}
+	root := newNode()
+	for _, entry := range entries {
+		parts := strings.Split(strings.ReplaceAll(entry.Path, "\\", "/"), "/")
+		current := root
+		for _, part := range parts[:len(parts)-1] {
+			if current.dirs[part] == nil {
+				current.dirs[part] = newNode()
+			}
+			current = current.dirs[part]
+		}
+		current.files[parts[len(parts)-1]] = entry
+	}
+
+	var objects []Object
+	var build func(n *node) fp.Checksum
+	build = func(n *node) fp.Checksum {
+		type item struct {
+			sortKey  string
+			mode     Mode
+			name     string
+			checksum fp.Checksum
+		}
+		var items []item
+		for name, entry := range n.files {
+			items = append(items, item{name, entry.Mode, name, entry.Checksum})
+		}
+		for name, dir := range n.dirs {
+			// git sorts directories as if their names ended with a slash
+			items = append(items, item{name + "/", ModeDirectory, name, build(dir)})
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].sortKey < items[j].sortKey })
+		var content []byte
+		for _, it := range items {
+			raw, err := hex.DecodeString(string(it.checksum))
+			if err != nil {
+				panic("Illegal state: " + string(it.checksum))
+			}
+			content = append(content, string(it.mode)+" "+it.name+"\x00"...)
+			content = append(content, raw...)
+		}
+		object := newObject(ObjectTypeTree, content, algo)
+		objects = append(objects, object)
+		return object.Checksum
+	}
+	build(root)
+	return objects
+}
+
+// NewCommit builds a commit natively. ident is "Name <email>", as returned by RunGetIdent.
+func NewCommit(tree fp.Checksum, parents []fp.Checksum, ident string, date time.Time, message string, algo fp.Algo) Object {
+	var sb strings.Builder
+	sb.WriteString("tree " + string(tree) + "\n")
+	for _, parent := range parents {
+		sb.WriteString("parent " + string(parent) + "\n")
+	}
+	signature := ident + " " + strconv.FormatInt(date.Unix(), 10) + " " + date.Format("-0700")
+	sb.WriteString("author " + signature + "\n")
+	sb.WriteString("committer " + signature + "\n")
+	sb.WriteString("\n" + message)
+	return newObject(ObjectTypeCommit, []byte(sb.String()), algo)
+}
+
+// RunGetIdent returns the user's identity as "Name <email>", or orto's if git doesn't have one.
+func (env Env) RunGetIdent() string {
+	out, err := runToString(env.PathToBinary, "var", "GIT_COMMITTER_IDENT")
+	if err != nil {
+		return "orto <orto@localhost>"
+	}
+	// Drop the timestamp and timezone
+	fields := strings.Fields(strings.TrimSpace(out))
+	if len(fields) < 3 {
+		log.Fatal("Could not parse git output: " + out)
+	}
+	return strings.Join(fields[:len(fields)-2], " ")
+}
+
+type BundleRef struct {
+	Name     string
+	Checksum fp.Checksum
+}
+
+// WriteBundle writes a bundle without prerequisites, with the given refs and a pack whose entries, written by a
+// PackWriter, are read from packEntries.
+func WriteBundle(w io.Writer, algo fp.Algo, refs []BundleRef, count int, packEntries io.Reader) error {
+	bw := bufio.NewWriter(w)
+	if algo == fp.SHA1 {
+		_, _ = bw.WriteString("# v2 git bundle\n")
+	} else {
+		_, _ = bw.WriteString("# v3 git bundle\n@object-format=sha256\n")
+	}
+	for _, ref := range refs {
+		_, _ = bw.WriteString(string(ref.Checksum) + " " + ref.Name + "\n")
+	}
+	_, _ = bw.WriteString("\n")
+
+	// The pack ends with a checksum of itself
+	packHash := fp.NewHash(algo)
+	pack := io.MultiWriter(bw, packHash)
+	header := []byte("PACK")
+	header = binary.BigEndian.AppendUint32(header, 2)
+	header = binary.BigEndian.AppendUint32(header, uint32(count))
+	if _, err := pack.Write(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(pack, packEntries); err != nil {
+		return err
+	}
+	if _, err := bw.Write(packHash.Sum(nil)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,128 @@
+package git_test
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+func TestBuildTrees(t *testing.T) {
+	empty := fp.Checksum("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+	objects := git.BuildTrees([]git.TreeEntry{
+		{Mode: git.ModeFile, Checksum: empty, Path: "dir/b"},
+		{Mode: git.ModeFile, Checksum: empty, Path: "a"},
+		{Mode: git.ModeFile, Checksum: empty, Path: "dir.x"},
+	}, fp.SHA1)
+	assert.Equal(t, 2, len(objects))
+	assert.Equal(t, fp.Checksum("4277b6e69d25e5efa77c455340557b384a4c018a"), objects[0].Checksum)
+	// As written by git write-tree, with "dir.x" before "dir"
+	assert.Equal(t, fp.Checksum("ecce4a1f2ac299fc7b8e7849c5757afe62810f93"), objects[1].Checksum)
+	assert.Equal(t, empty, fp.ChecksumObject(git.ObjectTypeBlob, nil, fp.SHA1))
+}
+
+// failingWriter takes the first n bytes, then fails.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		return written, errors.New("full")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestCatFile(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	t.Chdir(root)
+	assert.Equal(t, nil, exec.Command("git", "init", "--quiet").Run())
+	writeBlob := func(content string) fp.Checksum {
+		t.Helper()
+		cmd := exec.Command("git", "hash-object", "-w", "--stdin")
+		cmd.Stdin = strings.NewReader(content)
+		out, err := cmd.Output()
+		assert.Equal(t, nil, err)
+		return fp.NewChecksum(strings.TrimSpace(string(out)))
+	}
+	large := strings.Repeat("0123456789", 10000)
+	first := writeBlob(large)
+	second := writeBlob("second\n")
+
+	check, err := git.NewCatFile("git", false)
+	assert.Equal(t, nil, err)
+	info, err := check.Info(first)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, git.ObjectInfo{Checksum: first, Type: git.ObjectTypeBlob, Size: int64(len(large))}, info)
+	assert.Equal(t, nil, check.Close())
+
+	batch, err := git.NewCatFile("git", true)
+	assert.Equal(t, nil, err)
+	defer batch.Close()
+	var content bytes.Buffer
+	info, err = batch.Stream(first, &content)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(len(large)), info.Size)
+	assert.Equal(t, large, content.String())
+	// A writer that fails mid-object leaves the process ready for the next one
+	_, err = batch.Stream(first, &failingWriter{n: 100})
+	assert.NotEqual(t, nil, err)
+	content.Reset()
+	info, err = batch.Stream(second, &content)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, second, info.Checksum)
+	assert.Equal(t, "second\n", content.String())
+}
+
+func TestResolveCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	t.Chdir(root)
+	for _, variable := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(variable, "orto")
+	}
+	for _, variable := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(variable, "orto@example.com")
+	}
+	runGit := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", args...).Output()
+		assert.Equal(t, nil, err)
+		return strings.TrimSpace(string(out))
+	}
+	runGit("init", "--quiet")
+	runGit("commit", "--quiet", "--allow-empty", "-m", "First")
+	first := fp.NewChecksum(runGit("rev-parse", "HEAD"))
+	runGit("tag", "-a", "-m", "Annotated", "v1")
+	runGit("commit", "--quiet", "--allow-empty", "-m", "Second")
+
+	env := git.Env{PathToBinary: "git"}
+	for _, revision := range []string{"HEAD~1", "v1", string(first)} {
+		commit, found := env.RunResolveCommit(revision)
+		assert.True(t, found, revision)
+		// An annotated tag is resolved to its commit
+		assert.Equal(t, first, commit, revision)
+	}
+	assert.Equal(t, env.RunGetHead(), fp.NewChecksum(runGit("rev-parse", "HEAD")))
+	// Options are never taken as revisions
+	for _, revision := range []string{"HEAD~2", "unknown", "--all"} {
+		_, found := env.RunResolveCommit(revision)
+		assert.False(t, found, revision)
+	}
+	tree := runGit("rev-parse", "HEAD^{tree}")
+	_, found := env.RunResolveCommit(tree)
+	assert.False(t, found)
+}
@@ -0,0 +1,200 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anknetau/orto/fp"
+)
+
+// Repo is a bare repository that orto writes into, as opposed to the Env that it reads from. Commands run with
+// GIT_DIR set to it.
+type Repo struct {
+	PathToBinary string
+	AbsGitDir    string
+}
+
+// TreeEntry is a file in a tree to be written with RunWriteTree.
+type TreeEntry struct {
+	Mode     Mode
+	Checksum fp.Checksum
+	Path     string
+}
+
+// OpenBareRepo opens the bare repository at absGitDir, creating it if it doesn't exist with the given object format
+// and with HEAD pointing at initialBranch.
+func OpenBareRepo(pathToBinary string, absGitDir string, algo fp.Algo, initialBranch string) Repo {
+	if !filepath.IsAbs(absGitDir) {
+		panic("Not an absolute path: " + absGitDir)
+	}
+	repo := Repo{PathToBinary: pathToBinary, AbsGitDir: absGitDir}
+	if _, err := os.Stat(filepath.Join(absGitDir, "HEAD")); os.IsNotExist(err) {
+		objectFormat := "sha1"
+		if algo == fp.SHA256 {
+			objectFormat = "sha256"
+		}
+		cmd := exec.Command(pathToBinary, "init", "--bare", "--quiet", "--object-format="+objectFormat, "--initial-branch="+initialBranch, absGitDir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Fatalf("Cannot create repository %s: %s %s", absGitDir, err, out)
+		}
+	}
+	repoAlgo := fp.AlgoOfGitObjectFormat(strings.TrimSpace(repo.run(nil, "rev-parse", "--show-object-format")))
+	if repoAlgo != algo {
+		log.Fatalf("Repository %s uses %s but the source uses %s", absGitDir, repoAlgo, algo)
+	}
+	return repo
+}
+
+func (repo Repo) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(repo.PathToBinary, args...)
+	cmd.Env = append(os.Environ(), "GIT_DIR="+repo.AbsGitDir)
+	return cmd
+}
+
+func (repo Repo) run(stdin io.Reader, args ...string) string {
+	out, err := repo.output(repo.command(args...), stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// output runs a command made by command, with what git says on stderr in the error.
+func (repo Repo) output(cmd *exec.Cmd, stdin io.Reader) (string, error) {
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed in %s: %s %s", cmd.Args[1], repo.AbsGitDir, err, stderr.String())
+	}
+	return string(out), nil
+}
+
+// NewHasher launches a long-lived git hash-object process that also stores the files it hashes in the repository,
+// without applying any filters.
+func (repo Repo) NewHasher() (*Hasher, error) {
+	return startHasher(repo.command("hash-object", "-w", "--no-filters", "--stdin-paths"))
+}
+
+// RunWriteBlob stores content in the repository.
+func (repo Repo) RunWriteBlob(content io.Reader) fp.Checksum {
+	return fp.NewChecksum(strings.TrimSpace(repo.run(content, "hash-object", "-w", "--no-filters", "--stdin")))
+}
+
+// RunCopyBlob copies a blob from the repository of env into this one, streaming its content.
+func (repo Repo) RunCopyBlob(env Env, checksum fp.Checksum) {
+	reader, writer := io.Pipe()
+	go func() {
+		env.RunStreamRawContent(checksum, writer)
+		_ = writer.Close()
+	}()
+	if copied := repo.RunWriteBlob(reader); copied != checksum {
+		panic("Illegal state: copied " + string(checksum) + " as " + string(copied))
+	}
+}
+
+// RunWriteTree writes a tree, including subtrees, with exactly the given entries. It is built in a private index
+// file, so that no worktree is needed, which is removed again whether or not that works.
+func (repo Repo) RunWriteTree(entries []TreeEntry) fp.Checksum {
+	absTempDir, err := os.MkdirTemp("", "orto-index-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	indexCommand := func(args ...string) *exec.Cmd {
+		cmd := repo.command(args...)
+		cmd.Env = append(cmd.Env, "GIT_INDEX_FILE="+filepath.Join(absTempDir, "index"))
+		return cmd
+	}
+	var indexInfo bytes.Buffer
+	for _, entry := range entries {
+		indexInfo.WriteString(string(entry.Mode) + " " + string(entry.Checksum) + "\t" + filepath.ToSlash(entry.Path) + "\x00")
+	}
+	_, err = repo.output(indexCommand("update-index", "-z", "--index-info"), &indexInfo)
+	var out string
+	if err == nil {
+		out, err = repo.output(indexCommand("write-tree"), nil)
+	}
+	if removeErr := os.RemoveAll(absTempDir); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return fp.NewChecksum(strings.TrimSpace(out))
+}
+
+// RunCommitTree creates a commit of tree with the given parent, if any, dated at date. The user's identity is used
+// when git has one, otherwise orto's.
+func (repo Repo) RunCommitTree(tree fp.Checksum, parent fp.Checksum, message string, date time.Time) fp.Checksum {
+	args := []string{"commit-tree", string(tree), "-F", "-"}
+	if parent != "" {
+		args = append(args, "-p", string(parent))
+	}
+	cmd := repo.command(args...)
+	gitDate := date.Format(time.RFC3339)
+	cmd.Env = append(cmd.Env, "GIT_AUTHOR_DATE="+gitDate, "GIT_COMMITTER_DATE="+gitDate)
+	if err := repo.command("var", "GIT_COMMITTER_IDENT").Run(); err != nil {
+		cmd.Env = append(cmd.Env, "GIT_AUTHOR_NAME=orto", "GIT_AUTHOR_EMAIL=orto@localhost",
+			"GIT_COMMITTER_NAME=orto", "GIT_COMMITTER_EMAIL=orto@localhost")
+	}
+	out, err := repo.output(cmd, strings.NewReader(message))
+	if err != nil {
+		log.Fatalf("Cannot commit: %s", err)
+	}
+	return fp.NewChecksum(strings.TrimSpace(out))
+}
+
+// RunResolveCommit returns the commit that ref points to, if it exists.
+func (repo Repo) RunResolveCommit(ref string) (fp.Checksum, bool) {
+	out, err := repo.command("rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return "", false
+		}
+		log.Fatal(err)
+	}
+	return fp.NewChecksum(strings.TrimSpace(string(out))), true
+}
+
+// RunUpdateRef points ref at commit, but only if it still points at oldCommit, or doesn't exist if that is empty.
+func (repo Repo) RunUpdateRef(ref string, commit fp.Checksum, oldCommit fp.Checksum) {
+	repo.run(nil, "update-ref", ref, string(commit), string(oldCommit))
+}
+
+// BranchNameOfPath turns an absolute path into a valid branch name, eg "/home/me/my repo" into "home/me/my_repo".
+func BranchNameOfPath(absPath string) string {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(absPath), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+				return r
+			}
+			return '_'
+		}, part)
+		part = strings.ReplaceAll(part, "..", "__")
+		if strings.HasPrefix(part, ".") {
+			part = "_" + part[1:]
+		}
+		if strings.HasSuffix(part, ".") || strings.HasSuffix(part, ".lock") {
+			part += "_"
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "root"
+	}
+	return strings.Join(parts, "/")
+}
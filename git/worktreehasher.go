@@ -0,0 +1,321 @@
+package git
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/anknetau/orto/fp"
+)
+
+// hashAttributes are the attributes that make git filter a file before hashing it.
+var hashAttributes = []string{"text", "eol", "crlf", "filter", "ident", "working-tree-encoding"}
+
+const (
+	attributeUnspecified = "unspecified"
+	attributeUnset       = "unset"
+)
+
+// WorktreeHasher calculates the checksums that git gives files in the worktree. It hashes in process, and only asks
+// git, through a Hasher, for files that git would filter first: those with a filter, ident or working-tree-encoding
+// attribute, and those with carriage returns when line endings may be converted.
+type WorktreeHasher struct {
+	env           Env
+	autoCRLF      bool
+	attributes    *AttributeChecker
+	attributeDirs *attributeDirs // Or nil when attributes may come from outside the worktree, and apply to any path
+	mu            sync.Mutex     // Guards fallback
+	fallback      *Hasher
+}
+
+// NewWorktreeHasher prepares to hash paths relative to the root of the worktree, which is the working directory.
+// Don't forget to call Close() when done!
+func (env Env) NewWorktreeHasher() (*WorktreeHasher, error) {
+	attributes, err := env.NewAttributeChecker(hashAttributes)
+	if err != nil {
+		return nil, err
+	}
+	autoCRLF := env.RunGetConfig("core.autocrlf")
+	h := &WorktreeHasher{
+		env:        env,
+		autoCRLF:   autoCRLF == "true" || autoCRLF == "input",
+		attributes: attributes,
+	}
+	if !env.hasAttributesOutsideWorktree() {
+		h.attributeDirs = env.newAttributeDirs()
+	}
+	return h, nil
+}
+
+// checkAttributes looks up the attributes of path, only asking git if an attributes file could apply to it. Otherwise
+// every attribute is unspecified, which an empty map says as well.
+func (h *WorktreeHasher) checkAttributes(path string) (map[string]string, error) {
+	if h.attributeDirs != nil {
+		apply, err := h.attributeDirs.apply(filepath.Dir(path))
+		if err != nil || !apply {
+			return map[string]string{}, err
+		}
+	}
+	return h.attributes.Check(path)
+}
+
+// Hash returns the checksum of the file at path, and whether git's filters were involved.
+func (h *WorktreeHasher) Hash(path string) (fp.Checksum, bool, error) {
+	attributes, err := h.checkAttributes(path)
+	if err != nil {
+		return "", false, err
+	}
+	isSet := attributesAreSet(attributes)
+	if h.env.Algo == fp.UNKNOWN || isSet("filter") || isSet("ident") || isSet("working-tree-encoding") {
+		checksum, err := h.hashWithGit(path)
+		return checksum, true, err
+	}
+	checksum, hasCR, err := fp.ChecksumBlobFile(path, h.env.Algo)
+	if err != nil || !hasCR || attributes["text"] == attributeUnset || attributes["crlf"] == attributeUnset {
+		return checksum, false, err
+	}
+	if h.autoCRLF || isSet("text") || isSet("eol") || isSet("crlf") {
+		// Whether the line endings are converted depends on git's heuristics, so let git decide
+		gitChecksum, err := h.hashWithGit(path)
+		return gitChecksum, gitChecksum != checksum, err
+	}
+	return checksum, false, nil
+}
+
+// MayFilter is true if git could filter the file at path before hashing it, without looking at its content.
+func (h *WorktreeHasher) MayFilter(path string) (bool, error) {
+	attributes, err := h.checkAttributes(path)
+	if err != nil {
+		return false, err
+	}
+	isSet := attributesAreSet(attributes)
+	if isSet("filter") || isSet("ident") || isSet("working-tree-encoding") {
+		return true, nil
+	}
+	if attributes["text"] == attributeUnset || attributes["crlf"] == attributeUnset {
+		return false, nil
+	}
+	return h.autoCRLF || isSet("text") || isSet("eol") || isSet("crlf"), nil
+}
+
+func attributesAreSet(attributes map[string]string) func(name string) bool {
+	return func(name string) bool {
+		value, found := attributes[name]
+		return found && value != attributeUnspecified && value != attributeUnset
+	}
+}
+
+func (h *WorktreeHasher) hashWithGit(path string) (fp.Checksum, error) {
+	h.mu.Lock()
+	if h.fallback == nil {
+		fallback, err := NewHasher(h.env.PathToBinary)
+		if err != nil {
+			h.mu.Unlock()
+			return "", err
+		}
+		h.fallback = fallback
+	}
+	h.mu.Unlock()
+	checksum, err := h.fallback.Hash(path)
+	if err != nil {
+		return "", err
+	}
+	return fp.NewChecksum(checksum), nil
+}
+
+// Close closes the hasher
+func (h *WorktreeHasher) Close() error {
+	err := h.attributes.Close()
+	if h.fallback != nil {
+		return errors.Join(err, h.fallback.Close())
+	}
+	return err
+}
+
+// attributesFileName is the name of the attributes files in the worktree.
+const attributesFileName = ".gitattributes"
+
+// attributeDirs knows which directories of the worktree have an attributes file in them or above them, so that git is
+// only asked for the attributes of paths that one could apply to.
+type attributeDirs struct {
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+// newAttributeDirs starts with the directories of the attributes files in the index, which git reads when they are not
+// in the worktree.
+func (env Env) newAttributeDirs() *attributeDirs {
+	out, err := runToString(env.PathToBinary, "ls-files", "-z", "--", ":(glob)**/"+attributesFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dirs := make(map[string]bool)
+	for _, path := range strings.Split(out, "\x00") {
+		if path != "" {
+			dirs[filepath.Dir(filepath.FromSlash(path))] = true
+		}
+	}
+	return &attributeDirs{dirs: dirs}
+}
+
+// apply is true if an attributes file applies to the files in dir, a directory relative to the root of the worktree.
+func (d *attributeDirs) apply(dir string) (bool, error) {
+	d.mu.Lock()
+	found, known := d.dirs[dir]
+	d.mu.Unlock()
+	if known {
+		return found, nil
+	}
+	_, err := os.Lstat(filepath.Join(dir, attributesFileName))
+	if err == nil {
+		found = true
+	} else if !os.IsNotExist(err) {
+		return false, err
+	} else if parent := filepath.Dir(dir); parent != dir {
+		if found, err = d.apply(parent); err != nil {
+			return false, err
+		}
+	}
+	d.mu.Lock()
+	d.dirs[dir] = found
+	d.mu.Unlock()
+	return found, nil
+}
+
+// hasAttributesOutsideWorktree is true if there is an attributes file that applies to every path of the worktree:
+// info/attributes, or the user's or the system's attributes file. When not sure, it is true.
+func (env Env) hasAttributesOutsideWorktree() bool {
+	info, err := runToString(env.PathToBinary, "rev-parse", "--git-path", "info/attributes")
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths := []string{strings.TrimSpace(info)}
+	if global, err := runToString(env.PathToBinary, "var", "GIT_ATTR_GLOBAL"); err == nil {
+		// git 2.42 and later know where the others are
+		system, err := runToString(env.PathToBinary, "var", "GIT_ATTR_SYSTEM")
+		if err != nil {
+			return true
+		}
+		paths = append(paths, strings.TrimSpace(global), strings.TrimSpace(system))
+	} else {
+		paths = append(paths, env.globalAttributesFile(), "/etc/gitattributes")
+		// Otherwise, the system's file is relative to where git is installed, eg /usr/local/etc/gitattributes for
+		// /usr/local/libexec/git-core
+		execPath, err := runToString(env.PathToBinary, "--exec-path")
+		if err != nil {
+			return true
+		}
+		prefix := filepath.Dir(filepath.Dir(strings.TrimSpace(execPath)))
+		paths = append(paths, filepath.Join(prefix, "etc", "gitattributes"))
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// globalAttributesFile is the user's attributes file, for versions of git that can't say.
+func (env Env) globalAttributesFile() string {
+	out, err := runToString(env.PathToBinary, "config", "--type=path", "--get", "core.attributesFile")
+	if err == nil {
+		return strings.TrimSpace(out)
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "git", "attributes")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "git", "attributes")
+}
+
+// AttributeChecker is a long-lived git check-attr process, which looks up the values of some attributes for one path
+// at a time.
+type AttributeChecker struct {
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	br         *bufio.Reader
+	mu         sync.Mutex // serialize write->read pairs
+	attributes []string
+}
+
+// NewAttributeChecker launches git check-attr for the given attributes.
+// Don't forget to call Close() when done!
+func (env Env) NewAttributeChecker(attributes []string) (*AttributeChecker, error) {
+	cmd := exec.Command(env.PathToBinary, append([]string{"check-attr", "--stdin", "-z"}, attributes...)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		_ = stdin.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		_ = stdin.Close()
+		return nil, err
+	}
+	return &AttributeChecker{cmd: cmd, stdin: stdin, br: bufio.NewReader(stdout), attributes: attributes}, nil
+}
+
+// Check returns the values of the attributes for path, as "set", "unset", "unspecified" or a value.
+func (c *AttributeChecker) Check(path string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if os.PathSeparator == '\\' {
+		path = strings.ReplaceAll(path, "\\", "/")
+	}
+	if _, err := io.WriteString(c.stdin, path+"\x00"); err != nil {
+		return nil, err
+	}
+	// The output is path, attribute and value for every attribute, each terminated by NUL
+	result := make(map[string]string, len(c.attributes))
+	for range c.attributes {
+		var fields [3]string
+		for i := range fields {
+			field, err := c.br.ReadString(0)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = strings.TrimSuffix(field, "\x00")
+		}
+		if fields[0] != path {
+			log.Fatal("Could not parse git check-attr output for " + path + ": " + fields[0])
+		}
+		result[fields[1]] = fields[2]
+	}
+	return result, nil
+}
+
+// Close closes the checker
+func (c *AttributeChecker) Close() error {
+	_ = c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+// RunGetConfig returns the value of a configuration key, or "" if it is not set.
+func (env Env) RunGetConfig(key string) string {
+	out, err := runToString(env.PathToBinary, "config", "--get", key)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return ""
+		}
+		log.Fatal(err)
+	}
+	return strings.TrimSpace(out)
+}
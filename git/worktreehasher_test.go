@@ -0,0 +1,67 @@
+package git_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+func TestWorktreeHasherAttributes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	t.Setenv("HOME", root)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "config"))
+	t.Chdir(root)
+	runGit := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", root}, args...)...).Output()
+		assert.Equal(t, nil, err)
+		return strings.TrimSpace(string(out))
+	}
+	write := func(path string, content string) {
+		t.Helper()
+		assert.Equal(t, nil, os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755))
+		assert.Equal(t, nil, os.WriteFile(filepath.Join(root, path), []byte(content), 0644))
+	}
+	runGit("init", "--quiet")
+	write("crlf.txt", "a\r\n")
+	write(filepath.Join("text", "crlf.txt"), "a\r\n")
+	write(filepath.Join("text", "sub", "crlf.txt"), "a\r\n")
+	write(filepath.Join("text", ".gitattributes"), "*.txt text\n")
+	// Only staged, which git still reads
+	write(filepath.Join("staged", "crlf.txt"), "a\r\n")
+	write(filepath.Join("staged", ".gitattributes"), "*.txt text\n")
+	runGit("add", filepath.Join("staged", ".gitattributes"))
+	assert.Equal(t, nil, os.Remove(filepath.Join(root, "staged", ".gitattributes")))
+
+	env := git.Find("git", root)
+	hasher, err := env.NewWorktreeHasher()
+	assert.Equal(t, nil, err)
+	defer hasher.Close()
+	unfiltered := fp.ChecksumObject("blob", []byte("a\r\n"), env.Algo)
+	for _, test := range []struct {
+		path      string
+		mayFilter bool
+	}{
+		{"crlf.txt", false},
+		{filepath.Join("text", "crlf.txt"), true},
+		{filepath.Join("text", "sub", "crlf.txt"), true},
+		{filepath.Join("staged", "crlf.txt"), true},
+	} {
+		checksum, filtered, err := hasher.Hash(test.path)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, fp.Checksum(runGit("hash-object", test.path)), checksum, test.path)
+		assert.Equal(t, checksum != unfiltered, filtered, test.path)
+		mayFilter, err := hasher.MayFilter(test.path)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, test.mayFilter, mayFilter, test.path)
+	}
+}
@@ -5,7 +5,20 @@ go 1.25.0
 replace github.com/anknetau/orto => ../orto
 
 require (
-	golang.org/x/mod v0.27.0 // indirect
-	golang.org/x/sync v0.16.0 // indirect
-	golang.org/x/tools v0.36.0 // indirect
+	filippo.io/age v1.3.2
+	github.com/BurntSushi/toml v1.5.0
+	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.20.1
+	github.com/ulikunitz/xz v0.5.17
 )
+
+require (
+	filippo.io/hpke v0.4.0 // indirect
+	golang.org/x/crypto v0.55.0 // indirect
+	golang.org/x/mod v0.39.0 // indirect
+	golang.org/x/sync v0.22.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/tools v0.49.0 // indirect
+)
+
+tool golang.org/x/tools/cmd/stringer
@@ -0,0 +1,226 @@
+package orto
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ExtractChangeSet unpacks a change set archive into a new temporary directory, and returns the path to the manifest
+// within it. The caller should remove the temporary directory when done.
+func ExtractChangeSet(absArchive string, format OutputFormat) (string, string) {
+	if format != OutputFormatZip && !format.IsTar() {
+		log.Fatalf("Cannot restore from %s output", format)
+	}
+	absTempDir, err := os.MkdirTemp("", "orto-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	PrintLogHeader("Extracting " + absArchive + " to " + absTempDir)
+	if format == OutputFormatZip {
+		extractZip(absArchive, absTempDir)
+	} else {
+		extractTar(absArchive, format, absTempDir)
+	}
+	absManifest := findManifest(absTempDir)
+	// An archive with nothing but deletions has no change set directory
+	err = os.MkdirAll(strings.TrimSuffix(absManifest, ".json"), 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return absTempDir, absManifest
+}
+
+func extractZip(absArchive string, absTempDir string) {
+	reader, err := zip.OpenReader(absArchive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reader.Close()
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		// No format stores symlinks in zip archives
+		if !file.Mode().IsRegular() {
+			log.Fatalf("Unsupported entry in archive: %s", file.Name)
+		}
+		read, err := file.Open()
+		if err != nil {
+			log.Fatal(err)
+		}
+		extractFile(absTempDir, file.Name, file.Mode().Perm(), read)
+		_ = read.Close()
+	}
+}
+
+// extractFile writes an entry of an archive as a regular file. Nothing else is ever made, so that no entry can be
+// written through another one.
+func extractFile(absTempDir string, name string, perm os.FileMode, read io.Reader) {
+	relPath := filepath.FromSlash(name)
+	if !filepath.IsLocal(relPath) {
+		log.Fatal("Archive contains a non-local path: " + name)
+	}
+	fp.ValidFilePathForOrtoOrDie(relPath)
+	parent := absTempDir
+	for _, part := range fp.FilepathParts(filepath.Dir(relPath)) {
+		parent = filepath.Join(parent, part)
+		stat, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		if !stat.IsDir() {
+			log.Fatalf("Unsupported entry in archive: %s is inside a file", name)
+		}
+	}
+	fp.CreateIntermediateDirectoriesForFile(relPath, absTempDir)
+	write, err := os.OpenFile(filepath.Join(absTempDir, relPath), os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer write.Close()
+	_, err = io.Copy(write, read)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newDecompressor(format OutputFormat, r io.Reader) (io.Reader, error) {
+	switch format {
+	case OutputFormatTar:
+		return r, nil
+	case OutputFormatTarGz:
+		return gzip.NewReader(r)
+	case OutputFormatTarBz2:
+		return bzip2.NewReader(r), nil
+	case OutputFormatTarZstd:
+		return zstd.NewReader(r)
+	case OutputFormatTarXz:
+		return xz.NewReader(r)
+	}
+	panic("Not a tar format: " + string(format))
+}
+
+func extractTar(absArchive string, format OutputFormat, absTempDir string) {
+	f, err := os.Open(absArchive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	decompressor, err := newDecompressor(format, bufio.NewReader(f))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reader := tar.NewReader(decompressor)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			extractFile(absTempDir, header.Name, header.FileInfo().Mode().Perm(), reader)
+		case tar.TypeSymlink:
+			// Extracted as a file holding the target, which is how the other formats store symlinks
+			extractFile(absTempDir, header.Name, storedPerm(git.ModeSymlink), strings.NewReader(header.Linkname))
+		case tar.TypeDir:
+		default:
+			log.Fatalf("Unsupported entry in archive: %s", header.Name)
+		}
+	}
+}
+
+// findManifest finds the single <name>.json at the top of an extracted change set.
+func findManifest(absDir string) string {
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var found []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			found = append(found, filepath.Join(absDir, entry.Name()))
+		}
+	}
+	if len(found) != 1 {
+		log.Fatalf("Expected a single change set manifest in the archive, found %d", len(found))
+	}
+	return found[0]
+}
+
+// ReadArchiveManifest reads the manifest of a change set archive without extracting anything else.
+func ReadArchiveManifest(absArchive string, format OutputFormat) Manifest {
+	isManifest := func(name string) bool {
+		return !strings.Contains(name, "/") && strings.HasSuffix(name, ".json")
+	}
+	if format == OutputFormatZip {
+		reader, err := zip.OpenReader(absArchive)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer reader.Close()
+		for _, file := range reader.File {
+			if isManifest(file.Name) {
+				read, err := file.Open()
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer read.Close()
+				content, err := io.ReadAll(read)
+				if err != nil {
+					log.Fatal(err)
+				}
+				return DecodeManifest(content, absArchive)
+			}
+		}
+	} else if format.IsTar() {
+		f, err := os.Open(absArchive)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		decompressor, err := newDecompressor(format, bufio.NewReader(f))
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The manifest is written last, so the whole archive is read
+		reader := tar.NewReader(decompressor)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			if header.Typeflag == tar.TypeReg && isManifest(header.Name) {
+				content, err := io.ReadAll(reader)
+				if err != nil {
+					log.Fatal(err)
+				}
+				return DecodeManifest(content, absArchive)
+			}
+		}
+	} else {
+		log.Fatalf("Cannot read %s output", format)
+	}
+	log.Fatalf("No change set manifest in %s", absArchive)
+	return Manifest{}
+}
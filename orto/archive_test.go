@@ -0,0 +1,89 @@
+package orto_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/orto"
+)
+
+// writeTestTar writes a tar archive with the given entries. Regular files hold as many x's as their size.
+func writeTestTar(t *testing.T, path string, headers ...*tar.Header) {
+	t.Helper()
+	f, err := os.Create(path)
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	writer := tar.NewWriter(f)
+	for _, header := range headers {
+		assert.Equal(t, nil, writer.WriteHeader(header))
+		_, err = writer.Write([]byte(strings.Repeat("x", int(header.Size))))
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, nil, writer.Close())
+}
+
+func TestExtractTar(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("TMPDIR", root)
+	outside := filepath.Join(root, "outside")
+	assert.Equal(t, nil, os.Mkdir(outside, 0755))
+
+	archive := filepath.Join(root, "links.tar")
+	writeTestTar(t, archive,
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "cs/worktree/link", Linkname: outside, Mode: 0777},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "cs/worktree/run.sh", Size: 3, Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "cs.json", Size: 2, Mode: 0644},
+	)
+	absTempDir, absManifest := orto.ExtractChangeSet(archive, orto.OutputFormatTar)
+	assert.Equal(t, filepath.Join(absTempDir, "cs.json"), absManifest)
+	// A symlink is extracted as a file holding its target
+	stat, err := os.Lstat(filepath.Join(absTempDir, "cs", "worktree", "link"))
+	assert.Equal(t, nil, err)
+	assert.True(t, stat.Mode().IsRegular())
+	assert.Equal(t, outside, readTestFile(t, filepath.Join(absTempDir, "cs", "worktree", "link")))
+	stat, err = os.Stat(filepath.Join(absTempDir, "cs", "worktree", "run.sh"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+
+	archive = filepath.Join(root, "through.tar")
+	writeTestTar(t, archive,
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "cs/link", Linkname: outside, Mode: 0777},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "cs/link/written", Size: 1, Mode: 0644},
+	)
+	expectFatal(t, "through", "Unsupported entry in archive: cs/link/written is inside a file", func() {
+		orto.ExtractChangeSet(archive, orto.OutputFormatTar)
+	})
+	_, err = os.Lstat(filepath.Join(outside, "written"))
+	assert.True(t, os.IsNotExist(err))
+
+	archive = filepath.Join(root, "hardlink.tar")
+	writeTestTar(t, archive, &tar.Header{Typeflag: tar.TypeLink, Name: "cs/link", Linkname: "cs.json"})
+	expectFatal(t, "hardlink", "Unsupported entry in archive: cs/link", func() {
+		orto.ExtractChangeSet(archive, orto.OutputFormatTar)
+	})
+}
+
+func TestExtractZip(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("TMPDIR", root)
+	archive := filepath.Join(root, "links.zip")
+	f, err := os.Create(archive)
+	assert.Equal(t, nil, err)
+	writer := zip.NewWriter(f)
+	header := &zip.FileHeader{Name: "cs/link"}
+	header.SetMode(os.ModeSymlink | 0777)
+	write, err := writer.CreateHeader(header)
+	assert.Equal(t, nil, err)
+	_, err = write.Write([]byte(root))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, writer.Close())
+	assert.Equal(t, nil, f.Close())
+	expectFatal(t, "symlink", "Unsupported entry in archive: cs/link", func() {
+		orto.ExtractChangeSet(archive, orto.OutputFormatZip)
+	})
+}
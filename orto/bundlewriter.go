@@ -0,0 +1,148 @@
+package orto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+// bundleWriter writes a change set as a git bundle with a single commit, built natively. Its tree has the same layout
+// as gitRepoWriter's, and it can be fetched or cloned from, eg `git clone x.bundle`. The pack needs the number of
+// objects in its header, so its entries go to a temporary file until the end.
+type bundleWriter struct {
+	ctx      OutputContext
+	temp     *os.File
+	buffered *bufio.Writer
+	pack     *git.PackWriter
+	entries  []git.TreeEntry
+}
+
+func (w *bundleWriter) begin() error {
+	temp, err := os.CreateTemp("", "orto-pack-")
+	if err != nil {
+		return err
+	}
+	w.temp = temp
+	w.buffered = bufio.NewWriter(temp)
+	w.pack = git.NewPackWriter(w.buffered)
+	return nil
+}
+
+func (w *bundleWriter) putFile(path string, fsFile *FSFile, checksum fp.Checksum, filtered bool) error {
+	info, err := fsFile.DirEntry.Info()
+	if err != nil {
+		return err
+	}
+	if filtered {
+		// The content is stored as is, so it needs its own checksum
+		checksum, _, err = fp.ChecksumBlobFile(fsFile.Path, w.ctx.GitEnv.Algo)
+		if err != nil {
+			return err
+		}
+	}
+	w.entries = append(w.entries, git.TreeEntry{Mode: git.ModeOfFileMode(info.Mode()), Checksum: checksum, Path: path})
+	if w.pack.Has(checksum) {
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fsFile.Path)
+		if err != nil {
+			return err
+		}
+		return w.pack.WriteObject(checksum, git.ObjectTypeBlob, int64(len(target)), strings.NewReader(target))
+	}
+	read, err := os.Open(fsFile.Path)
+	if err != nil {
+		return err
+	}
+	defer read.Close()
+	// The size is in the header, so the file must not grow or shrink while being copied
+	return w.pack.WriteObject(checksum, git.ObjectTypeBlob, info.Size(), read)
+}
+
+func (w *bundleWriter) putBlob(path string, checksum fp.Checksum, mode git.Mode) error {
+	w.entries = append(w.entries, git.TreeEntry{Mode: mode, Checksum: checksum, Path: path})
+	if w.pack.Has(checksum) {
+		return nil
+	}
+	size := w.ctx.GitEnv.RunGetObjectSize(checksum)
+	reader, writer := io.Pipe()
+	go func() {
+		w.ctx.GitEnv.RunStreamRawContent(checksum, writer)
+		_ = writer.Close()
+	}()
+	defer reader.Close()
+	return w.pack.WriteObject(checksum, git.ObjectTypeBlob, size, reader)
+}
+
+func (w *bundleWriter) putStream(path string, write func(io.Writer) error) error {
+	// The checksum and the size come before the content, so it is spooled first
+	return spool(write, func(f *os.File, size int64) error {
+		checksum, _, err := fp.ChecksumBlobFile(f.Name(), w.ctx.GitEnv.Algo)
+		if err != nil {
+			return err
+		}
+		w.entries = append(w.entries, git.TreeEntry{Mode: git.ModeFile, Checksum: checksum, Path: path})
+		if w.pack.Has(checksum) {
+			return nil
+		}
+		return w.pack.WriteObject(checksum, git.ObjectTypeBlob, size, f)
+	})
+}
+
+func (w *bundleWriter) finish(manifest Manifest) error {
+	defer func() {
+		_ = w.temp.Close()
+		_ = os.Remove(w.temp.Name())
+	}()
+	algo := w.ctx.GitEnv.Algo
+	var content bytes.Buffer
+	if err := EncodeManifest(&content, manifest); err != nil {
+		return err
+	}
+	manifestBlob := git.Object{Type: git.ObjectTypeBlob, Content: content.Bytes()}
+	manifestBlob.Checksum = fp.ChecksumObject(manifestBlob.Type, manifestBlob.Content, algo)
+	w.entries = append(w.entries, git.TreeEntry{Mode: git.ModeFile, Checksum: manifestBlob.Checksum, Path: GitRepoManifestFile})
+	objects := git.BuildTrees(w.entries, algo)
+	commit := git.NewCommit(objects[len(objects)-1].Checksum, nil, w.ctx.GitEnv.RunGetIdent(), w.ctx.StartTime, snapshotMessage(manifest), algo)
+	objects = append(objects, manifestBlob, commit)
+	for _, object := range objects {
+		if err := w.pack.Write(object); err != nil {
+			return err
+		}
+	}
+	if err := w.buffered.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// O_EXCL as the destination was checked to not exist
+	f, err := os.OpenFile(w.ctx.DestinationFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	refs := []git.BundleRef{
+		{Name: "HEAD", Checksum: commit.Checksum},
+		{Name: "refs/heads/" + strings.ReplaceAll(w.ctx.ChangeSetName, "..", "_"), Checksum: commit.Checksum},
+	}
+	if err = git.WriteBundle(f, algo, refs, w.pack.Count(), w.temp); err != nil {
+		return err
+	}
+	PrintLogHeader("Bundled commit " + string(commit.Checksum))
+	return f.Close()
+}
+
+func (w *bundleWriter) location(path string) string {
+	if path == "" {
+		return w.ctx.DestinationFile
+	}
+	return w.ctx.DestinationFile + ":" + path
+}
@@ -1,6 +1,12 @@
 package orto
 
-import "github.com/anknetau/orto/git"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
 
 //go:generate go run golang.org/x/tools/cmd/stringer -type=ChangeKind
 type ChangeKind int
@@ -15,7 +21,36 @@ const (
 )
 
 type Change struct {
-	Kind    ChangeKind
-	FsFile  *FSFile
-	GitBlob *git.Blob
+	Kind      ChangeKind
+	FsFile    *FSFile
+	GitBlob   *git.Blob
+	Checksum  fp.Checksum     // Checksum of FsFile, when it was hashed
+	Filtered  bool            // Checksum is of FsFile after git's filters, eg for line endings, rather than as it is
+	IgnoredBy *PathRule       // The rule that made orto ignore the file, if it was one
+	Secrets   []SecretFinding // What looks like secrets in FsFile, if it was scanned
+}
+
+// ParseChangeKind accepts either the full name of a kind (eg "ChangeKindAdded") or just its suffix, in any case
+// (eg "added").
+func ParseChangeKind(s string) (ChangeKind, bool) {
+	for kind := ChangeKindAdded; kind <= ChangeKindIgnoredByOrto; kind++ {
+		name := kind.String()
+		if strings.EqualFold(s, name) || strings.EqualFold(s, strings.TrimPrefix(name, "ChangeKind")) {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+func (kind ChangeKind) MarshalText() ([]byte, error) {
+	return []byte(strings.TrimPrefix(kind.String(), "ChangeKind")), nil
+}
+
+func (kind *ChangeKind) UnmarshalText(text []byte) error {
+	parsed, ok := ParseChangeKind(string(text))
+	if !ok {
+		return fmt.Errorf("unknown change kind %q", text)
+	}
+	*kind = parsed
+	return nil
 }
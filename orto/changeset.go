@@ -0,0 +1,142 @@
+package orto
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/anknetau/orto/fp"
+)
+
+// ChangeSet is a change set that was written by orto, ready to be read from a directory.
+type ChangeSet struct {
+	AbsDir          string
+	AbsManifestFile string
+	Manifest        Manifest
+	absTempDir      string // Where an archive was extracted to, if any
+	identities      []age.Identity
+}
+
+// OpenChangeSet opens a change set from its directory, its .json file or an archive, which is extracted to a
+// temporary directory. Don't forget to call Close() when done!
+func OpenChangeSet(path string) ChangeSet {
+	absTempDir := ""
+	if format := OutputFormatOfDestination(path); format.IsFile() {
+		absArchive, err := filepath.Abs(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		absTempDir, path = ExtractChangeSet(absArchive, format)
+	}
+	absDir, absManifestFile := CheckChangeSet(path)
+	return ChangeSet{
+		AbsDir:          absDir,
+		AbsManifestFile: absManifestFile,
+		Manifest:        ReadManifest(absManifestFile),
+		absTempDir:      absTempDir,
+	}
+}
+
+// ReadChangeSetManifest reads the manifest of a change set like OpenChangeSet would, but without extracting archives.
+func ReadChangeSetManifest(path string) Manifest {
+	if format := OutputFormatOfDestination(path); format.IsFile() {
+		absArchive, err := filepath.Abs(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return ReadArchiveManifest(absArchive, format)
+	}
+	_, absManifestFile := CheckChangeSet(path)
+	return ReadManifest(absManifestFile)
+}
+
+// UseIdentities sets the keys that encrypted files are decrypted with, as they are read when they are opened.
+func (changeSet *ChangeSet) UseIdentities(identities []age.Identity) {
+	changeSet.identities = identities
+}
+
+// IsReadable is false for a file that is encrypted, when there are no identities to decrypt it with.
+func (changeSet ChangeSet) IsReadable(content string, encrypted bool) bool {
+	return content == "" || !encrypted || len(changeSet.identities) > 0
+}
+
+// Path returns the absolute path of a file in the change set, given its path in the manifest. An encrypted file is
+// still encrypted there.
+func (changeSet ChangeSet) Path(content string) string {
+	return filepath.Join(changeSet.AbsDir, content)
+}
+
+// Open opens a file in the change set, given its path in the manifest, decrypting it as it is read if it is
+// encrypted. A symlink is opened as its target, as git stores it.
+func (changeSet ChangeSet) Open(content string, encrypted bool) (io.ReadCloser, error) {
+	absPath := changeSet.Path(content)
+	if !encrypted {
+		stat, err := os.Lstat(absPath)
+		if err != nil {
+			return nil, err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(absPath)
+			return io.NopCloser(strings.NewReader(target)), err
+		}
+		return os.Open(absPath)
+	}
+	if !changeSet.IsReadable(content, encrypted) {
+		return nil, errors.New("it is encrypted, and no identity was given to decrypt it")
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := age.Decrypt(f, changeSet.identities...)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decrypted, f}, nil
+}
+
+// Checksum is the checksum git gives a file in the change set. For an encrypted file, this is of the decrypted
+// content, which is read twice, as the size comes first.
+func (changeSet ChangeSet) Checksum(content string, encrypted bool, algo fp.Algo) (fp.Checksum, error) {
+	if !encrypted {
+		checksum, _, err := fp.ChecksumBlobFile(changeSet.Path(content), algo)
+		return checksum, err
+	}
+	read := func(w io.Writer) (int64, error) {
+		r, err := changeSet.Open(content, encrypted)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		return io.Copy(w, r)
+	}
+	size, err := read(io.Discard)
+	if err != nil {
+		return "", err
+	}
+	hash := fp.NewHash(algo)
+	hash.Write([]byte("blob " + strconv.FormatInt(size, 10) + "\x00"))
+	if n, err := read(hash); err != nil {
+		return "", err
+	} else if n != size {
+		return "", errors.New("content changed while being read")
+	}
+	return fp.Checksum(hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// Close removes the extracted archive, if any
+func (changeSet *ChangeSet) Close() {
+	if changeSet.absTempDir != "" {
+		_ = os.RemoveAll(changeSet.absTempDir)
+	}
+}
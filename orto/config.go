@@ -0,0 +1,214 @@
+package orto
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/BurntSushi/toml"
+)
+
+// RepoConfigFileName is the name of the configuration file at the root of a worktree.
+const RepoConfigFileName = ".orto.toml"
+
+// Config is a layer of settings, read from a configuration file or given explicitly, eg on the command line.
+// Values that are not set are nil, so that a layer only overrides what it sets. Layers are resolved in the order
+// explicit settings, then the worktree's .orto.toml, then the user's config.toml, then the defaults. The worktree's
+// layer comes with the code, so it cannot set which git is run, where output goes or which keys are used, and can
+// only make encryption and the handling of secrets stricter.
+type Config struct {
+	Ignore              []string      `toml:"ignore"`  // Paths that are never saved, in the syntax of .ortoignore
+	Include             []string      `toml:"include"` // If not empty, only the paths that match are saved
+	Format              *OutputFormat `toml:"format"`  // Used when the destination doesn't imply a format
+	Destination         *string       `toml:"destination"`
+	PathToGitBinary     *string       `toml:"git"`
+	CopyDotGit          *bool         `toml:"copy_dot_git"`
+	CopyGitIgnoredFiles *bool         `toml:"copy_git_ignored_files"`
+	CopyUnchangedFiles  *bool         `toml:"copy_unchanged_files"`
+	GitIgnoredInclude   []string      `toml:"git_ignored_include"`  // If not empty, only the files git ignores that match are copied
+	GitIgnoredExclude   []string      `toml:"git_ignored_exclude"`  // Files git ignores that are never copied
+	GitIgnoredMaxSize   *int64        `toml:"git_ignored_max_size"` // In bytes
+	Encrypt             *EncryptScope `toml:"encrypt"`
+	Recipients          []string      `toml:"recipients"`     // age public keys that change sets are encrypted for
+	IdentityFiles       []string      `toml:"identity_files"` // age private keys that decrypt change sets
+	Secrets             *SecretAction `toml:"secrets"`
+	SecretRules         []SecretRule  `toml:"secret_rules"` // Used besides BuiltinSecretRules
+}
+
+// Over returns the settings of config, with those it doesn't set taken from lower. Patterns are added together.
+func (config Config) Over(lower Config) Config {
+	return Config{
+		Ignore:              slices.Concat(lower.Ignore, config.Ignore),
+		Include:             slices.Concat(lower.Include, config.Include),
+		Format:              firstSet(config.Format, lower.Format),
+		Destination:         firstSet(config.Destination, lower.Destination),
+		PathToGitBinary:     firstSet(config.PathToGitBinary, lower.PathToGitBinary),
+		CopyDotGit:          firstSet(config.CopyDotGit, lower.CopyDotGit),
+		CopyGitIgnoredFiles: firstSet(config.CopyGitIgnoredFiles, lower.CopyGitIgnoredFiles),
+		CopyUnchangedFiles:  firstSet(config.CopyUnchangedFiles, lower.CopyUnchangedFiles),
+		GitIgnoredInclude:   slices.Concat(lower.GitIgnoredInclude, config.GitIgnoredInclude),
+		GitIgnoredExclude:   slices.Concat(lower.GitIgnoredExclude, config.GitIgnoredExclude),
+		GitIgnoredMaxSize:   firstSet(config.GitIgnoredMaxSize, lower.GitIgnoredMaxSize),
+		Encrypt:             firstSet(config.Encrypt, lower.Encrypt),
+		Recipients:          slices.Concat(lower.Recipients, config.Recipients),
+		IdentityFiles:       slices.Concat(lower.IdentityFiles, config.IdentityFiles),
+		Secrets:             firstSet(config.Secrets, lower.Secrets),
+		SecretRules:         slices.Concat(lower.SecretRules, config.SecretRules),
+	}
+}
+
+func firstSet[T any](value *T, lower *T) *T {
+	if value != nil {
+		return value
+	}
+	return lower
+}
+
+// DefaultConfig is the bottom layer, used for what nothing else sets.
+func DefaultConfig() Config {
+	git := "git"
+	no := false
+	maxSize := int64(DefaultGitIgnoredMaxSize)
+	encrypt := EncryptNone
+	secrets := SecretsReport
+	return Config{
+		PathToGitBinary:     &git,
+		CopyDotGit:          &no,
+		CopyGitIgnoredFiles: &no,
+		CopyUnchangedFiles:  &no,
+		GitIgnoredExclude:   DefaultGitIgnoredExcludes,
+		GitIgnoredMaxSize:   &maxSize,
+		Encrypt:             &encrypt,
+		Secrets:             &secrets,
+	}
+}
+
+// LoadConfig reads the configuration layers that apply to the worktree containing absDir, and puts them under
+// explicit.
+func LoadConfig(explicit Config, absDir string) Config {
+	lower := DefaultConfig()
+	if absUserConfigFile := UserConfigFile(); absUserConfigFile != "" {
+		if userConfig, found := ReadConfigFile(absUserConfigFile); found {
+			lower = userConfig.Over(lower)
+		}
+	}
+	config := explicit
+	if absRepoConfigFile, found := FindRepoConfigFile(absDir); found {
+		repoConfig, _ := ReadConfigFile(absRepoConfigFile)
+		checkRepoConfig(repoConfig, lower, absRepoConfigFile)
+		config = config.Over(repoConfig)
+	}
+	return config.Over(lower)
+}
+
+// checkRepoConfig refuses the settings that only the user can make, as anyone who can commit can change a worktree's
+// configuration. Encryption and secrets can be made stricter than in the layers below, ie the user's and the defaults.
+func checkRepoConfig(config Config, lower Config, absPath string) {
+	if config.PathToGitBinary != nil {
+		log.Fatalf("git cannot be set in %s, only in %s or with -PathToGitBinary", absPath, UserConfigFile())
+	}
+	if config.Destination != nil {
+		log.Fatalf("destination cannot be set in %s, only in %s or on the command line", absPath, UserConfigFile())
+	}
+	if len(config.IdentityFiles) > 0 {
+		log.Fatalf("identity_files cannot be set in %s, only in %s or with -Identity", absPath, UserConfigFile())
+	}
+	if len(config.Recipients) > 0 {
+		log.Fatalf("recipients cannot be set in %s, only in %s or with -Recipient", absPath, UserConfigFile())
+	}
+	if config.Encrypt != nil && config.Encrypt.strictness() < lower.Encrypt.strictness() {
+		log.Fatalf("encrypt = \"%s\" in %s would encrypt less than \"%s\", which is configured in %s or the default", *config.Encrypt, absPath, *lower.Encrypt, UserConfigFile())
+	}
+	if config.Secrets != nil && config.Secrets.strictness() < lower.Secrets.strictness() {
+		log.Fatalf("secrets = \"%s\" in %s is less strict than \"%s\", which is configured in %s or the default", *config.Secrets, absPath, *lower.Secrets, UserConfigFile())
+	}
+}
+
+// UserConfigFile is config.toml in the user's configuration directory, see userConfigDir.
+func UserConfigFile() string {
+	return userConfigFile("config.toml")
+}
+
+// UserIgnoreFile has patterns, in the syntax of .ortoignore, of paths that orto ignores in every worktree.
+func UserIgnoreFile() string {
+	return userConfigFile("ignore")
+}
+
+// userConfigFile is a file in $XDG_CONFIG_HOME/orto, or in ~/.config/orto. It is empty if there is no home.
+func userConfigFile(name string) string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if !filepath.IsAbs(configHome) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "orto", name)
+}
+
+// FindRepoConfigFile looks for .orto.toml at the root of the worktree containing absDir. This happens before git is
+// found, as the configuration can say which git to use, so the root is the nearest directory that has a .git.
+func FindRepoConfigFile(absDir string) (string, bool) {
+	for dir := absDir; ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			absPath := filepath.Join(dir, RepoConfigFileName)
+			_, err := os.Stat(absPath)
+			return absPath, err == nil
+		}
+		if filepath.Dir(dir) == dir {
+			return "", false
+		}
+	}
+}
+
+// ReadConfigFile reads a configuration file, or returns false if there is none. A relative destination or identity
+// file in it is relative to the directory of the file.
+func ReadConfigFile(absPath string) (Config, bool) {
+	var config Config
+	metadata, err := toml.DecodeFile(absPath, &config)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Config{}, false
+	}
+	if err != nil {
+		log.Fatalf("Cannot read configuration file %s: %s", absPath, err)
+	}
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		log.Fatalf("Unknown setting '%s' in configuration file %s", undecoded[0], absPath)
+	}
+	for _, pattern := range slices.Concat(config.Ignore, config.Include, config.GitIgnoredInclude, config.GitIgnoredExclude) {
+		if !ValidPathRule(pattern) {
+			log.Fatalf("Invalid path pattern '%s' in configuration file %s", pattern, absPath)
+		}
+	}
+	if config.GitIgnoredMaxSize != nil && *config.GitIgnoredMaxSize < 0 {
+		log.Fatalf("Negative git_ignored_max_size in configuration file %s", absPath)
+	}
+	if config.Encrypt != nil && !config.Encrypt.IsValid() {
+		log.Fatalf("Unknown encryption %s in configuration file %s", *config.Encrypt, absPath)
+	}
+	if config.Secrets != nil && !config.Secrets.IsValid() {
+		log.Fatalf("Unknown secrets action %s in configuration file %s", *config.Secrets, absPath)
+	}
+	for _, rule := range config.SecretRules {
+		if _, err := rule.compile(); err != nil {
+			log.Fatalf("Invalid secret rule in configuration file %s: %s", absPath, err)
+		}
+	}
+	if config.Format != nil && !config.Format.IsRegistered() {
+		log.Fatalf("Unknown output format %s in configuration file %s", *config.Format, absPath)
+	}
+	if config.Destination != nil && *config.Destination != "" && !filepath.IsAbs(*config.Destination) {
+		destination := filepath.Join(filepath.Dir(absPath), *config.Destination)
+		config.Destination = &destination
+	}
+	for i, identityFile := range config.IdentityFiles {
+		if !filepath.IsAbs(identityFile) {
+			config.IdentityFiles[i] = filepath.Join(filepath.Dir(absPath), identityFile)
+		}
+	}
+	return config, true
+}
@@ -0,0 +1,140 @@
+package orto_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/orto"
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	assert.Equal(t, nil, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Equal(t, nil, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestLoadConfig(t *testing.T) {
+	root := t.TempDir()
+	configHome := filepath.Join(root, "config")
+	worktree := filepath.Join(root, "worktree")
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(worktree, ".git"), 0755))
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(worktree, "src"), 0755))
+
+	config := orto.LoadConfig(orto.Config{}, filepath.Join(worktree, "src"))
+	assert.Equal(t, "git", *config.PathToGitBinary)
+	assert.False(t, *config.CopyUnchangedFiles)
+	assert.True(t, config.Destination == nil && config.Format == nil)
+	assert.Equal(t, orto.SecretsReport, *config.Secrets)
+	assert.Equal(t, int64(orto.DefaultGitIgnoredMaxSize), *config.GitIgnoredMaxSize)
+	assert.True(t, slices.Contains(config.GitIgnoredExclude, "node_modules/"))
+	for _, pattern := range config.GitIgnoredExclude {
+		assert.True(t, orto.ValidPathRule(pattern), pattern)
+	}
+
+	writeTestFile(t, filepath.Join(configHome, "orto", "config.toml"), `
+git = "/usr/local/bin/git"
+destination = "../../backups"
+ignore = ["*.log"]
+format = "zip"
+copy_unchanged_files = true
+copy_dot_git = true
+`)
+	writeTestFile(t, filepath.Join(worktree, orto.RepoConfigFileName), `
+ignore = ["vendor/"]
+format = "tar.gz"
+copy_unchanged_files = false
+git_ignored_exclude = ["!build/"]
+git_ignored_max_size = 4096
+secrets = "refuse"
+
+[[secret_rules]]
+name = "internal-token"
+pattern = "itk_[a-z0-9]{32}"
+`)
+	no := false
+	config = orto.LoadConfig(orto.Config{Ignore: []string{"tmp/"}, CopyDotGit: &no}, filepath.Join(worktree, "src"))
+	assert.Equal(t, "/usr/local/bin/git", *config.PathToGitBinary)
+	assert.True(t, slices.Equal([]string{"*.log", "vendor/", "tmp/"}, config.Ignore))
+	assert.Equal(t, orto.OutputFormatTarGz, *config.Format)
+	assert.Equal(t, filepath.Join(root, "backups"), *config.Destination)
+	assert.False(t, *config.CopyUnchangedFiles)
+	assert.False(t, *config.CopyDotGit)
+	assert.False(t, *config.CopyGitIgnoredFiles)
+	assert.Equal(t, "!build/", config.GitIgnoredExclude[len(config.GitIgnoredExclude)-1])
+	assert.Equal(t, int64(4096), *config.GitIgnoredMaxSize)
+	assert.Equal(t, orto.SecretsRefuse, *config.Secrets)
+	assert.Equal(t, 1, len(config.SecretRules))
+	assert.Equal(t, "internal-token", config.SecretRules[0].Name)
+}
+
+func TestUserParametersResolve(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "config"))
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(root, ".git"), 0755))
+	writeTestFile(t, filepath.Join(root, "config", "orto", "config.toml"), `
+destination = "/backups"
+`)
+	writeTestFile(t, filepath.Join(root, orto.RepoConfigFileName), `
+format = "zip"
+copy_unchanged_files = true
+`)
+	params := orto.UserParameters{}
+	params.Resolve(root)
+	assert.Equal(t, "/backups", params.Destination)
+	assert.Equal(t, orto.OutputFormatZip, params.Format)
+	assert.True(t, params.CopyUnchangedFiles)
+	assert.Equal(t, "HEAD", params.BaseRevision)
+
+	// The destination implies a format, so the configured one is not used
+	params = orto.UserParameters{Destination: "out.tar"}
+	params.Resolve(root)
+	assert.Equal(t, "out.tar", params.Destination)
+	assert.Equal(t, orto.OutputFormat(""), params.Format)
+
+	no := false
+	params = orto.UserParameters{Format: orto.OutputFormatPatch, Config: orto.Config{CopyUnchangedFiles: &no}}
+	params.Resolve(root)
+	assert.Equal(t, orto.OutputFormatPatch, params.Format)
+	assert.False(t, params.CopyUnchangedFiles)
+}
+
+// TestRepoConfigRefuses checks that a worktree's configuration can't set what only the user can, nor weaken
+// encryption or the handling of secrets.
+func TestRepoConfigRefuses(t *testing.T) {
+	root := t.TempDir()
+	configHome := filepath.Join(root, "config")
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(root, ".git"), 0755))
+	writeTestFile(t, filepath.Join(configHome, "orto", "config.toml"), `
+encrypt = "untracked"
+secrets = "encrypt"
+recipients = ["age1user"]
+`)
+	load := func(repoConfig string) func() {
+		return func() {
+			writeTestFile(t, filepath.Join(root, orto.RepoConfigFileName), repoConfig)
+			orto.LoadConfig(orto.Config{}, root)
+		}
+	}
+
+	load(`
+encrypt = "all"
+secrets = "refuse"
+`)()
+	config := orto.LoadConfig(orto.Config{}, root)
+	assert.Equal(t, orto.EncryptAll, *config.Encrypt)
+	assert.Equal(t, orto.SecretsRefuse, *config.Secrets)
+	assert.True(t, slices.Equal([]string{"age1user"}, config.Recipients))
+	// The command line can still weaken them
+	none := orto.EncryptNone
+	config = orto.LoadConfig(orto.Config{Encrypt: &none}, root)
+	assert.Equal(t, orto.EncryptNone, *config.Encrypt)
+
+	expectFatal(t, "recipients", "recipients cannot be set in", load(`recipients = ["age1repo"]`))
+	expectFatal(t, "encrypt", `encrypt = "none" in `, load(`encrypt = "none"`))
+	expectFatal(t, "secrets", `secrets = "report" in `, load(`secrets = "report"`))
+	expectFatal(t, "git", "git cannot be set in", load(`git = "/tmp/git"`))
+}
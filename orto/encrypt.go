@@ -0,0 +1,133 @@
+package orto
+
+import (
+	"io"
+	"log"
+	"os"
+	"slices"
+
+	"filippo.io/age"
+)
+
+// EncryptScope says which files of a change set are encrypted.
+type EncryptScope string
+
+const (
+	EncryptNone      EncryptScope = "none"
+	EncryptUntracked EncryptScope = "untracked" // Files that are not in git, ie added and ignored ones
+	EncryptAll       EncryptScope = "all"       // Every file, including those from git
+)
+
+// EncryptedSuffix is added to the path of an encrypted file in a change set.
+const EncryptedSuffix = ".age"
+
+func (scope EncryptScope) IsValid() bool {
+	return scope == EncryptNone || scope == EncryptUntracked || scope == EncryptAll
+}
+
+// strictness orders the scopes by how many files they encrypt.
+func (scope EncryptScope) strictness() int {
+	return slices.Index([]EncryptScope{EncryptNone, EncryptUntracked, EncryptAll}, scope)
+}
+
+// Encryption is how the files of a change set are encrypted, with age: for X25519 recipients, or with a passphrase.
+type Encryption struct {
+	Scope      EncryptScope
+	Recipients []age.Recipient
+	Secrets    bool // Files that look like they hold secrets are encrypted too, whatever the scope
+}
+
+// NewEncryption checks the scope, and parses the recipients, which are age public keys ("age1..."). A passphrase can
+// be given instead of recipients, but not with them. Files with secrets are encrypted if secrets is SecretsEncrypt.
+func NewEncryption(scope EncryptScope, recipients []string, passphrase string, secrets SecretAction) Encryption {
+	if scope == "" {
+		scope = EncryptNone
+	}
+	if !scope.IsValid() {
+		log.Fatalf("Unknown encryption %s", scope)
+	}
+	encryption := Encryption{Scope: scope, Secrets: secrets == SecretsEncrypt}
+	if scope == EncryptNone && !encryption.Secrets {
+		return encryption
+	}
+	if passphrase != "" && len(recipients) > 0 {
+		log.Fatal("Encryption takes either recipients or a passphrase, not both")
+	}
+	if passphrase != "" {
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		encryption.Recipients = []age.Recipient{recipient}
+	}
+	for _, s := range recipients {
+		recipient, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			log.Fatalf("Invalid recipient %s: %s", s, err)
+		}
+		encryption.Recipients = append(encryption.Recipients, recipient)
+	}
+	if len(encryption.Recipients) == 0 && scope == EncryptNone {
+		log.Fatal("Encrypting the files that look like they hold secrets needs recipients or a passphrase")
+	} else if len(encryption.Recipients) == 0 {
+		log.Fatal("Encryption needs recipients or a passphrase")
+	}
+	return encryption
+}
+
+// encryptsFile is true for the worktree files of changes that are encrypted.
+func (encryption Encryption) encryptsFile(change Change) bool {
+	if encryption.Secrets && len(change.Secrets) > 0 {
+		return true
+	}
+	switch encryption.Scope {
+	case EncryptAll:
+		return true
+	case EncryptUntracked:
+		return change.Kind == ChangeKindAdded || change.Kind == ChangeKindIgnoredByGit
+	}
+	return false
+}
+
+// encryptsBlobs is true if the files that come from git are encrypted.
+func (encryption Encryption) encryptsBlobs() bool {
+	return encryption.Scope == EncryptAll
+}
+
+// encrypt writes to dst the encryption of what write writes, as it is written.
+func (encryption Encryption) encrypt(dst io.Writer, write func(io.Writer) error) error {
+	w, err := age.Encrypt(dst, encryption.Recipients...)
+	if err != nil {
+		return err
+	}
+	if err = write(w); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// ReadIdentities reads the age identity files, ie private keys, that decrypt change sets. A passphrase can be given
+// too, for change sets that were encrypted with one.
+func ReadIdentities(identityFiles []string, passphrase string) []age.Identity {
+	var identities []age.Identity
+	for _, path := range identityFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileIdentities, err := age.ParseIdentities(f)
+		_ = f.Close()
+		if err != nil {
+			log.Fatalf("Cannot read identity file %s: %s", path, err)
+		}
+		identities = append(identities, fileIdentities...)
+	}
+	if passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		identities = append(identities, identity)
+	}
+	return identities
+}
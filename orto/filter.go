@@ -0,0 +1,43 @@
+package orto
+
+import (
+	"slices"
+)
+
+// ChangeFilter selects changes by path and kind. An empty filter selects everything.
+// Include and Exclude are patterns in gitignore syntax, as for saving (see PathRule); Exclude wins over Include.
+type ChangeFilter struct {
+	Include  []string
+	Exclude  []string
+	Kinds    []ChangeKind
+	includes *PathMatcher
+	excludes *PathMatcher
+}
+
+// Check parses the patterns of the filter, and must be called before it is used.
+func (filter *ChangeFilter) Check() {
+	filter.includes = NewPathMatcher(ParsePathRules(filter.Include), "", "")
+	filter.excludes = NewPathMatcher(ParsePathRules(filter.Exclude), "", "")
+}
+
+func (filter ChangeFilter) IsEmpty() bool {
+	return len(filter.Include) == 0 && len(filter.Exclude) == 0 && len(filter.Kinds) == 0
+}
+
+func (filter ChangeFilter) Matches(change Change) bool {
+	if len(filter.Kinds) > 0 && !slices.Contains(filter.Kinds, change.Kind) {
+		return false
+	}
+	return filter.MatchesPath(changePath(change))
+}
+
+// MatchesPath only checks the path patterns of the filter.
+func (filter ChangeFilter) MatchesPath(cleanPath string) bool {
+	if filter.includes == nil || filter.excludes == nil {
+		panic("Illegal state: ChangeFilter not checked")
+	}
+	if !filter.includes.IsEmpty() && filter.includes.Match(cleanPath) == nil {
+		return false
+	}
+	return filter.excludes.Match(cleanPath) == nil
+}
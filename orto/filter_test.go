@@ -0,0 +1,41 @@
+package orto_test
+
+import (
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/git"
+	"github.com/anknetau/orto/orto"
+)
+
+func TestChangeFilter(t *testing.T) {
+	added := orto.Change{Kind: orto.ChangeKindAdded, FsFile: &orto.FSFile{CleanPath: "config/a.toml"}}
+	deleted := orto.Change{Kind: orto.ChangeKindDeleted, GitBlob: &git.Blob{CleanPath: "src/b.go"}}
+
+	test := func(filter orto.ChangeFilter, change orto.Change, expected bool) {
+		t.Helper()
+		filter.Check()
+		assert.Equal(t, expected, filter.Matches(change))
+	}
+	test(orto.ChangeFilter{}, added, true)
+	test(orto.ChangeFilter{Include: []string{"config/"}}, added, true)
+	test(orto.ChangeFilter{Include: []string{"config/"}}, deleted, false)
+	test(orto.ChangeFilter{Include: []string{"config/"}, Exclude: []string{"*.toml"}}, added, false)
+	// The same syntax as when saving, so "!" negates and "/" anchors
+	test(orto.ChangeFilter{Include: []string{"*.go", "!b.go"}}, deleted, false)
+	test(orto.ChangeFilter{Include: []string{"/b.go"}}, deleted, false)
+	test(orto.ChangeFilter{Include: []string{"/src/"}}, deleted, true)
+	test(orto.ChangeFilter{Kinds: []orto.ChangeKind{orto.ChangeKindDeleted}}, deleted, true)
+	test(orto.ChangeFilter{Kinds: []orto.ChangeKind{orto.ChangeKindDeleted}}, added, false)
+}
+
+func TestParseChangeKind(t *testing.T) {
+	kind, ok := orto.ParseChangeKind("deleted")
+	assert.True(t, ok)
+	assert.Equal(t, orto.ChangeKindDeleted, kind)
+	kind, ok = orto.ParseChangeKind("ChangeKindIgnoredByGit")
+	assert.True(t, ok)
+	assert.Equal(t, orto.ChangeKindIgnoredByGit, kind)
+	_, ok = orto.ParseChangeKind("renamed")
+	assert.False(t, ok)
+}
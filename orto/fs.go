@@ -1,8 +1,11 @@
 package orto
 
 import (
+	"iter"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/anknetau/orto/fp"
 )
@@ -20,29 +23,48 @@ func NewFSFile(path string, dirEntry os.DirEntry) FSFile {
 	return FSFile{cleanPath, path, dirEntry}
 }
 
-func FsReadDir(root string) []FSFile {
-	var entries []FSFile
-	var err = filepath.WalkDir(root, func(path string, dirEntry os.DirEntry, err error) error {
-		if err != nil {
-			return err
+// FsWalk yields the files under root, but not directories, in git's order: sorted byte by byte by path, with "/" as
+// the separator, so that they can be merged with the blobs from git. The file at absExcludedFile is skipped, which is
+// where the output goes when it is a single file inside the worktree.
+func FsWalk(root string, absExcludedFile string) iter.Seq[FSFile] {
+	return func(yield func(FSFile) bool) {
+		var walk func(relDir string) bool
+		walk = func(relDir string) bool {
+			dirEntries, err := os.ReadDir(filepath.Join(root, relDir))
+			if err != nil {
+				panic(err)
+			}
+			// git sorts directories as if their names ended with a slash
+			sortKey := func(dirEntry os.DirEntry) string {
+				if dirEntry.IsDir() {
+					return dirEntry.Name() + "/"
+				}
+				return dirEntry.Name()
+			}
+			slices.SortFunc(dirEntries, func(a, b os.DirEntry) int {
+				return strings.Compare(sortKey(a), sortKey(b))
+			})
+			for _, dirEntry := range dirEntries {
+				relPath := filepath.Join(relDir, dirEntry.Name())
+				if !filepath.IsLocal(relPath) {
+					panic(relPath)
+				}
+				if dirEntry.IsDir() {
+					if !walk(relPath) {
+						return false
+					}
+					continue
+				}
+				if absExcludedFile != "" && filepath.Join(root, relPath) == absExcludedFile {
+					continue
+				}
+				// TODO: add filepath.IsLocal() where needed, for security
+				if !yield(NewFSFile(relPath, dirEntry)) {
+					return false
+				}
+			}
+			return true
 		}
-		relPath, err := filepath.Rel(root, path)
-		if err != nil {
-			return err
-		}
-		if !filepath.IsLocal(relPath) {
-			panic(relPath)
-		}
-		if dirEntry.IsDir() {
-			return nil
-		}
-		// TODO: add filepath.IsLocal() where needed, for security
-		fsFile := NewFSFile(relPath, dirEntry)
-		entries = append(entries, fsFile)
-		return nil
-	})
-	if err != nil {
-		panic(err)
+		walk("")
 	}
-	return entries
 }
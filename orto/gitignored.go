@@ -0,0 +1,41 @@
+package orto
+
+import (
+	"log"
+)
+
+// DefaultGitIgnoredMaxSize is the largest file that git ignores that is copied, unless configured otherwise.
+const DefaultGitIgnoredMaxSize = 1 << 20
+
+// DefaultGitIgnoredExcludes are directories that git usually ignores, that hold dependencies or build outputs which
+// can be large and recreated. Their files are not copied unless a later pattern negates them, eg "!build/".
+var DefaultGitIgnoredExcludes = []string{
+	"node_modules/", "bower_components/", ".venv/", "venv/", "__pycache__/", ".tox/", ".gradle/", ".next/",
+	".nuxt/", ".terraform/", ".cache/", "target/", "build/", "dist/", "out/",
+}
+
+// gitIgnoredSelection decides which of the files that git ignores are copied.
+type gitIgnoredSelection struct {
+	includes *PathMatcher // If not empty, only the files that match
+	excludes *PathMatcher
+	maxSize  int64
+}
+
+// selects is true if a file that git ignores is to be copied. tooLarge is true if it would have been, but for its
+// size.
+func (selection *gitIgnoredSelection) selects(fsFile *FSFile) (selected bool, tooLarge bool) {
+	if selection.excludes.Match(fsFile.CleanPath) != nil {
+		return false, false
+	}
+	if !selection.includes.IsEmpty() && selection.includes.Match(fsFile.CleanPath) == nil {
+		return false, false
+	}
+	info, err := fsFile.DirEntry.Info()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info.Size() > selection.maxSize {
+		return false, true
+	}
+	return true, false
+}
@@ -0,0 +1,135 @@
+package orto
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+// GitRepoManifestFile is where the manifest goes in the tree of a snapshot commit.
+const GitRepoManifestFile = "orto.json"
+
+// gitRepoWriter adds a change set to a bare repository as a commit. Its tree has the same layout as the directory
+// output, with the manifest in GitRepoManifestFile. Each source worktree gets its own branch, named after its path,
+// so the parent of a snapshot is the previous snapshot of the same worktree.
+type gitRepoWriter struct {
+	ctx     OutputContext
+	repo    git.Repo
+	hasher  *git.Hasher
+	branch  string
+	parent  fp.Checksum
+	entries []git.TreeEntry
+}
+
+func (w *gitRepoWriter) begin() error {
+	w.branch = git.BranchNameOfPath(w.ctx.GitEnv.AbsRoot)
+	w.repo = git.OpenBareRepo(w.ctx.GitEnv.PathToBinary, w.ctx.DestinationDir, w.ctx.GitEnv.Algo, w.branch)
+	w.parent, _ = w.repo.RunResolveCommit(w.ref())
+	hasher, err := w.repo.NewHasher()
+	w.hasher = hasher
+	return err
+}
+
+func (w *gitRepoWriter) ref() string {
+	return "refs/heads/" + w.branch
+}
+
+func (w *gitRepoWriter) putFile(path string, fsFile *FSFile, _ fp.Checksum, _ bool) error {
+	info, err := fsFile.DirEntry.Info()
+	if err != nil {
+		return err
+	}
+	var checksum fp.Checksum
+	if info.Mode()&os.ModeSymlink != 0 {
+		// hash-object would follow the link
+		target, err := os.Readlink(fsFile.Path)
+		if err != nil {
+			return err
+		}
+		checksum = w.repo.RunWriteBlob(strings.NewReader(target))
+	} else {
+		hash, err := w.hasher.Hash(fsFile.Path)
+		if err != nil {
+			return err
+		}
+		checksum = fp.NewChecksum(hash)
+	}
+	w.entries = append(w.entries, git.TreeEntry{Mode: git.ModeOfFileMode(info.Mode()), Checksum: checksum, Path: path})
+	return nil
+}
+
+func (w *gitRepoWriter) putBlob(path string, checksum fp.Checksum, mode git.Mode) error {
+	w.repo.RunCopyBlob(w.ctx.GitEnv, checksum)
+	w.entries = append(w.entries, git.TreeEntry{Mode: mode, Checksum: checksum, Path: path})
+	return nil
+}
+
+func (w *gitRepoWriter) putStream(path string, write func(io.Writer) error) error {
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(write(writer))
+	}()
+	defer reader.Close()
+	checksum := w.repo.RunWriteBlob(reader)
+	w.entries = append(w.entries, git.TreeEntry{Mode: git.ModeFile, Checksum: checksum, Path: path})
+	return nil
+}
+
+func (w *gitRepoWriter) finish(manifest Manifest) error {
+	if err := w.hasher.Close(); err != nil {
+		return err
+	}
+	var content bytes.Buffer
+	if err := EncodeManifest(&content, manifest); err != nil {
+		return err
+	}
+	w.entries = append(w.entries, git.TreeEntry{Mode: git.ModeFile, Checksum: w.repo.RunWriteBlob(&content), Path: GitRepoManifestFile})
+
+	tree := w.repo.RunWriteTree(w.entries)
+	commit := w.repo.RunCommitTree(tree, w.parent, snapshotMessage(manifest), w.ctx.StartTime)
+	w.repo.RunUpdateRef(w.ref(), commit, w.parent)
+	PrintLogHeader("Committed " + string(commit) + " to " + w.branch)
+	return nil
+}
+
+func (w *gitRepoWriter) location(path string) string {
+	if path == "" {
+		return w.ctx.DestinationDir
+	}
+	return w.ctx.DestinationDir + ":" + path
+}
+
+// snapshotMessage describes a change set, with its source in trailers that `git log` and
+// `git interpret-trailers` understand.
+func snapshotMessage(manifest Manifest) string {
+	counts := make(map[ChangeKind]int)
+	for _, entry := range manifest.Changes {
+		counts[entry.Kind]++
+	}
+	count := func(n int, what string) string {
+		return strconv.Itoa(n) + " " + what
+	}
+	var sb strings.Builder
+	sb.WriteString(manifest.Name + "\n\n")
+	sb.WriteString("Snapshot of " + manifest.Source.Worktree + " by orto " + manifest.OrtoVersion + ": ")
+	sb.WriteString(strings.Join([]string{
+		count(counts[ChangeKindAdded], "added"),
+		count(counts[ChangeKindModified], "modified"),
+		count(counts[ChangeKindDeleted], "deleted"),
+		count(len(manifest.Index), "staged"),
+	}, ", ") + ".\n\n")
+	sb.WriteString("Orto-Source-Commit: " + string(manifest.Source.Commit) + "\n")
+	if manifest.Source.Base != "" {
+		sb.WriteString("Orto-Base-Commit: " + string(manifest.Source.Base) + "\n")
+	}
+	if manifest.Source.Branch != "" {
+		sb.WriteString("Orto-Source-Branch: " + manifest.Source.Branch + "\n")
+	}
+	sb.WriteString("Orto-Source-Worktree: " + manifest.Source.Worktree + "\n")
+	return sb.String()
+}
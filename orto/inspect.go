@@ -0,0 +1,239 @@
+package orto
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/patch"
+)
+
+// List prints the change sets in a store, ie a directory that change sets were saved into, one per line.
+func List(store string) {
+	absStore, err := filepath.Abs(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fp.IsAbsPathToDirOrDie(absStore, "Store")
+	if _, err := os.Stat(filepath.Join(absStore, "HEAD")); err == nil {
+		log.Fatalf("%s is a git repository, see its snapshots with: git --git-dir=%s log --all", store, store)
+	}
+	entries, err := os.ReadDir(absStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, entry := range entries {
+		absPath := filepath.Join(absStore, entry.Name())
+		name := entry.Name()
+		var manifest Manifest
+		if format := OutputFormatOfDestination(absPath); format.IsFile() && !entry.IsDir() {
+			if format != OutputFormatZip && !format.IsTar() {
+				continue
+			}
+			manifest = ReadArchiveManifest(absPath, format)
+		} else if absDir, isJson := strings.CutSuffix(absPath, ".json"); isJson && !entry.IsDir() {
+			if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+				continue
+			}
+			manifest = ReadManifest(absPath)
+			name = filepath.Base(absDir)
+		} else {
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, manifest.Created.Format("2006-01-02 15:04:05"),
+			shortChecksum(manifest.Source.Commit), manifest.Source.Branch, countChanges(manifest))
+	}
+}
+
+// Show prints what a change set contains.
+func Show(changeSet string) {
+	manifest := ReadChangeSetManifest(changeSet)
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	source := manifest.Source
+	_, _ = fmt.Fprintf(w, "Change set %s\n", manifest.Name)
+	_, _ = fmt.Fprintf(w, "Created    %s by orto %s\n", manifest.Created.Format("2006-01-02 15:04:05 -0700"), manifest.OrtoVersion)
+	_, _ = fmt.Fprintf(w, "Source     %s at %s", source.Worktree, source.Commit)
+	if source.Branch != "" {
+		_, _ = fmt.Fprintf(w, " on branch %s", source.Branch)
+	}
+	_, _ = fmt.Fprintln(w)
+	if source.Base != "" {
+		_, _ = fmt.Fprintf(w, "Base       %s at %s\n", source.BaseRevision, source.Base)
+	}
+	_, _ = fmt.Fprintf(w, "Changes    %s\n\n", countChanges(manifest))
+	for _, entry := range manifest.Changes {
+		switch entry.Kind {
+		case ChangeKindAdded, ChangeKindModified, ChangeKindDeleted:
+			_, _ = fmt.Fprintf(w, "  %-9s %s%s\n", strings.TrimPrefix(entry.Kind.String(), "ChangeKind"), entry.Path, secretsNote(entry.Secrets, entry.Encrypted))
+		case ChangeKindIgnoredByGit:
+			if entry.Content != "" {
+				_, _ = fmt.Fprintf(w, "  %-9s %s%s\n", "Ignored", entry.Path, secretsNote(entry.Secrets, entry.Encrypted))
+			}
+		}
+	}
+	for _, entry := range manifest.Index {
+		_, _ = fmt.Fprintf(w, "  %-9s %s%s\n", "Staged", entry.Path, secretsNote(entry.Secrets, entry.Encrypted))
+	}
+}
+
+// secretsNote lists the rules that found possible secrets in a file, if any.
+func secretsNote(secrets []SecretFinding, encrypted bool) string {
+	if len(secrets) == 0 {
+		return ""
+	}
+	var findings []string
+	for _, finding := range secrets {
+		findings = append(findings, finding.String())
+	}
+	note := " (possible secrets: " + strings.Join(findings, ", ")
+	if encrypted {
+		return note + ", encrypted)"
+	}
+	return note + ")"
+}
+
+func countChanges(manifest Manifest) string {
+	counts := make(map[ChangeKind]int)
+	for _, entry := range manifest.Changes {
+		counts[entry.Kind]++
+	}
+	return fmt.Sprintf("%d added, %d modified, %d deleted, %d staged",
+		counts[ChangeKindAdded], counts[ChangeKindModified], counts[ChangeKindDeleted], len(manifest.Index))
+}
+
+func shortChecksum(checksum fp.Checksum) string {
+	return string(checksum)[:min(12, len(checksum))]
+}
+
+// Diff prints the changes in a change set that match the filter as a patch, like the patch output format. Encrypted
+// files need identities that decrypt them.
+func Diff(changeSetPath string, filter ChangeFilter, identities []age.Identity) {
+	filter.Check()
+	changeSet := OpenChangeSet(changeSetPath)
+	defer changeSet.Close()
+	changeSet.UseIdentities(identities)
+	entries := slices.Clone(changeSet.Manifest.Changes)
+	slices.SortFunc(entries, func(a, b ManifestEntry) int {
+		return strings.Compare(filepath.ToSlash(a.Path), filepath.ToSlash(b.Path))
+	})
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, entry := range entries {
+		if entry.Kind != ChangeKindAdded && entry.Kind != ChangeKindModified && entry.Kind != ChangeKindDeleted {
+			continue
+		}
+		if !filter.Matches(entry.Change()) {
+			continue
+		}
+		filePatch := patch.FilePatch{Path: entry.Path}
+		if entry.Kind != ChangeKindAdded {
+			filePatch.OldMode = entry.GitMode
+			filePatch.OldChecksum = entry.GitChecksum
+			filePatch.Old = readChangeSetContent(changeSet, entry.BaseContent, entry.Encrypted, entry.Path)
+		}
+		if entry.Kind != ChangeKindDeleted {
+			filePatch.NewMode = entry.Mode
+			filePatch.NewChecksum = entry.Checksum
+			filePatch.New = readChangeSetContent(changeSet, entry.Content, entry.Encrypted, entry.Path)
+		}
+		if err := filePatch.Write(w); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func readChangeSetContent(changeSet ChangeSet, content string, encrypted bool, path string) []byte {
+	if content == "" {
+		log.Fatal("Change set has no content for " + path)
+	}
+	if !changeSet.IsReadable(content, encrypted) {
+		log.Fatalf("Cannot show %s: it is encrypted, and no identity was given to decrypt it", path)
+	}
+	read, err := changeSet.Open(content, encrypted)
+	if err != nil {
+		log.Fatalf("Cannot read %s: %s", path, err)
+	}
+	defer read.Close()
+	data, err := io.ReadAll(read)
+	if err != nil {
+		log.Fatalf("Cannot read %s: %s", path, err)
+	}
+	return data
+}
+
+// Verify checks that every file a change set refers to is there with the right checksum, and that it has nothing
+// else. It prints the problems found, and returns how many there were. The checksums of encrypted files are only
+// checked if identities that decrypt them are given.
+func Verify(changeSetPath string, identities []age.Identity) int {
+	changeSet := OpenChangeSet(changeSetPath)
+	defer changeSet.Close()
+	changeSet.UseIdentities(identities)
+	manifest := changeSet.Manifest
+	algo := manifest.Source.Algo
+	problems := 0
+	report := func(path string, problem string) {
+		problems++
+		_, _ = fmt.Fprintf(os.Stdout, "%s: %s\n", path, problem)
+	}
+	expected := make(map[string]bool)
+	check := func(content string, checksum fp.Checksum, encrypted bool, checkChecksum bool) {
+		if content == "" {
+			return
+		}
+		expected[content] = true
+		readable := changeSet.IsReadable(content, encrypted)
+		// Without identities, an encrypted file is still read, to see that it is there
+		actual, err := changeSet.Checksum(content, encrypted && readable, algo)
+		checkChecksum = checkChecksum && readable
+		if err != nil {
+			report(content, err.Error())
+		} else if checkChecksum && actual != checksum {
+			report(content, "checksum is "+string(actual)+", expected "+string(checksum))
+		}
+	}
+	for _, entry := range manifest.Changes {
+		// A filtered checksum can't be checked without git and the source's attributes
+		check(entry.Content, entry.Checksum, entry.Encrypted, !entry.Filtered)
+		check(entry.BaseContent, entry.GitChecksum, entry.Encrypted, true)
+		if entry.Content == "" && (entry.Kind == ChangeKindAdded || entry.Kind == ChangeKindModified) {
+			report(entry.Path, "no worktree content")
+		}
+		if entry.BaseContent == "" && (entry.Kind == ChangeKindModified || entry.Kind == ChangeKindDeleted) {
+			report(entry.Path, "no base content")
+		}
+	}
+	for _, entry := range manifest.Index {
+		check(entry.Content, entry.Checksum, entry.Encrypted, true)
+	}
+	err := filepath.WalkDir(changeSet.AbsDir, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil || dirEntry.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(changeSet.AbsDir, path)
+		if err != nil {
+			return err
+		}
+		if !expected[relPath] {
+			report(relPath, "not in the manifest")
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if problems == 0 {
+		_, _ = io.WriteString(os.Stdout, "Change set "+manifest.Name+" is complete\n")
+	}
+	return problems
+}
@@ -0,0 +1,248 @@
+package orto
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+// ManifestVersion is incremented whenever the manifest schema changes in a way older readers can't handle.
+const ManifestVersion = 1
+
+// A change set directory holds the worktree version of files under LayoutWorktreeDir, the version in HEAD under
+// LayoutBaseDir and the staged version under LayoutIndexDir, each at their original path. The manifest's entries point
+// into these.
+const (
+	LayoutWorktreeDir = "worktree"
+	LayoutBaseDir     = "base"
+	LayoutIndexDir    = "index"
+)
+
+// Manifest describes a change set, and is written as <name>.json next to it.
+type Manifest struct {
+	Version     int             `json:"version"`
+	OrtoVersion string          `json:"ortoVersion"`
+	Name        string          `json:"name"`
+	Created     time.Time       `json:"created"`
+	Source      Provenance      `json:"source"`
+	Changes     []ManifestEntry `json:"changes"`
+	Index       []IndexEntry    `json:"index"`
+}
+
+// Provenance records where a change set came from.
+type Provenance struct {
+	Worktree     string       `json:"worktree"`
+	Commit       fp.Checksum  `json:"commit"`
+	BaseRevision string       `json:"baseRevision,omitempty"`
+	Base         fp.Checksum  `json:"base,omitempty"` // The commit the worktree was compared with, if not HEAD
+	Branch       string       `json:"branch,omitempty"`
+	Detached     bool         `json:"detached"`
+	Upstream     string       `json:"upstream,omitempty"`
+	Ahead        *int         `json:"ahead,omitempty"`
+	Behind       *int         `json:"behind,omitempty"`
+	Remotes      []git.Remote `json:"remotes"`
+	StashCount   int          `json:"stashCount"`
+	GitVersion   string       `json:"gitVersion"`
+	Algo         fp.Algo      `json:"algo"`
+}
+
+func NewProvenance(gitEnv git.Env, headers git.StatusHeaders, remotes []git.Remote, baseRevision string, baseCommit fp.Checksum) Provenance {
+	provenance := Provenance{
+		Worktree:   gitEnv.AbsRoot,
+		Commit:     headers.Oid,
+		Branch:     headers.Head,
+		Detached:   headers.Detached,
+		Upstream:   headers.Upstream,
+		Remotes:    remotes,
+		StashCount: headers.StashCount,
+		GitVersion: gitEnv.Version,
+		Algo:       gitEnv.Algo,
+	}
+	if baseCommit != headers.Oid {
+		provenance.BaseRevision = baseRevision
+		provenance.Base = baseCommit
+	}
+	if provenance.Remotes == nil {
+		provenance.Remotes = []git.Remote{}
+	}
+	if headers.HasAheadBehind {
+		provenance.Ahead = &headers.Ahead
+		provenance.Behind = &headers.Behind
+	}
+	return provenance
+}
+
+// BaseCommit is the commit that the worktree was compared with.
+func (provenance Provenance) BaseCommit() fp.Checksum {
+	if provenance.Base != "" {
+		return provenance.Base
+	}
+	return provenance.Commit
+}
+
+// ManifestEntry records a single Change. Fields that don't apply to the change's kind are left out, eg a deleted
+// file has no worktree checksum.
+type ManifestEntry struct {
+	Kind        ChangeKind      `json:"kind"`
+	Path        string          `json:"path"`
+	Mode        git.Mode        `json:"mode,omitempty"`
+	GitMode     git.Mode        `json:"gitMode,omitempty"`
+	GitChecksum fp.Checksum     `json:"gitChecksum,omitempty"`
+	Checksum    fp.Checksum     `json:"checksum,omitempty"`
+	Filtered    bool            `json:"filtered,omitempty"` // Checksum is of the content after git's filters, not of Content
+	Size        int64           `json:"size"`
+	ModTime     *time.Time      `json:"modTime,omitempty"`
+	Content     string          `json:"content,omitempty"`     // Worktree version, relative to the change set
+	BaseContent string          `json:"baseContent,omitempty"` // HEAD version, relative to the change set
+	IgnoredBy   *PathRule       `json:"ignoredBy,omitempty"`
+	Encrypted   bool            `json:"encrypted,omitempty"` // Content and BaseContent are encrypted with age
+	Secrets     []SecretFinding `json:"secrets,omitempty"`   // What looks like secrets in the worktree version
+}
+
+// IndexEntry records a path whose staged version differs from HEAD.
+type IndexEntry struct {
+	Path      string          `json:"path"`
+	OrigPath  string          `json:"origPath,omitempty"`
+	Status    git.Status      `json:"status"`
+	Mode      git.Mode        `json:"mode"`
+	Checksum  fp.Checksum     `json:"checksum,omitempty"`
+	Size      int64           `json:"size,omitempty"`
+	Content   string          `json:"content,omitempty"`   // Staged version, relative to the change set
+	Encrypted bool            `json:"encrypted,omitempty"` // Content is encrypted with age
+	Secrets   []SecretFinding `json:"secrets,omitempty"`   // What looks like secrets in the staged version
+}
+
+func (entry IndexEntry) IsDeleted() bool {
+	return entry.Mode == git.ModeDeleted
+}
+
+func NewIndexEntry(indexChange git.IndexChange) IndexEntry {
+	entry := IndexEntry{
+		Path:     indexChange.Path,
+		OrigPath: indexChange.OrigPath,
+		Status:   indexChange.Status,
+		Mode:     indexChange.Mode,
+	}
+	if !indexChange.IsDeleted() {
+		entry.Checksum = indexChange.Checksum
+	}
+	return entry
+}
+
+func NewManifestEntry(change Change) ManifestEntry {
+	entry := ManifestEntry{
+		Kind:      change.Kind,
+		Path:      changePath(change),
+		Checksum:  change.Checksum,
+		Filtered:  change.Filtered,
+		IgnoredBy: change.IgnoredBy,
+		Secrets:   change.Secrets,
+	}
+	if change.GitBlob != nil {
+		entry.GitMode = change.GitBlob.Mode
+		entry.GitChecksum = change.GitBlob.Checksum
+		entry.Size = change.GitBlob.Size
+	}
+	if change.FsFile != nil && change.FsFile.DirEntry != nil {
+		info, err := change.FsFile.DirEntry.Info()
+		if err != nil {
+			log.Fatal(err)
+		}
+		modTime := info.ModTime().UTC()
+		entry.Mode = git.ModeOfFileMode(info.Mode())
+		entry.Size = info.Size()
+		entry.ModTime = &modTime
+	}
+	return entry
+}
+
+// Change rebuilds the Change that an entry was made from, without the file system details.
+func (entry ManifestEntry) Change() Change {
+	change := Change{Kind: entry.Kind, Checksum: entry.Checksum}
+	if entry.GitChecksum != "" {
+		change.GitBlob = &git.Blob{
+			CleanPath: entry.Path,
+			Path:      entry.Path,
+			Checksum:  entry.GitChecksum,
+			Mode:      entry.GitMode,
+			Size:      entry.Size,
+		}
+	}
+	if entry.Kind != ChangeKindDeleted {
+		change.FsFile = &FSFile{CleanPath: entry.Path, Path: entry.Path}
+	}
+	return change
+}
+
+func WriteManifest(absPath string, manifest Manifest) {
+	f, err := os.Create(absPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	err = EncodeManifest(f, manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func EncodeManifest(w io.Writer, manifest Manifest) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+func ReadManifest(absPath string) Manifest {
+	content, err := os.ReadFile(absPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return DecodeManifest(content, absPath)
+}
+
+// DecodeManifest parses and checks a manifest. absPath is where it came from, for errors.
+func DecodeManifest(content []byte, absPath string) Manifest {
+	var manifest Manifest
+	err := json.Unmarshal(content, &manifest)
+	if err != nil {
+		log.Fatalf("Cannot read change set manifest %s: %s", absPath, err)
+	}
+	if manifest.Version != ManifestVersion {
+		log.Fatalf("Change set manifest %s has version %d, but only version %d is supported", absPath, manifest.Version, ManifestVersion)
+	}
+	if manifest.Source.Commit.GetAlgo() == fp.UNKNOWN {
+		log.Fatalf("Change set manifest %s has no valid source commit", absPath)
+	}
+	for _, entry := range manifest.Changes {
+		validManifestPathOrDie(entry.Path)
+		if entry.Content != "" {
+			validManifestPathOrDie(entry.Content)
+		}
+		if entry.BaseContent != "" {
+			validManifestPathOrDie(entry.BaseContent)
+		}
+	}
+	for _, entry := range manifest.Index {
+		validManifestPathOrDie(entry.Path)
+		if entry.Content != "" {
+			validManifestPathOrDie(entry.Content)
+		}
+		if !entry.IsDeleted() && (entry.Checksum.GetAlgo() == fp.UNKNOWN || entry.Content == "") {
+			log.Fatal("Change set index entry is incomplete: " + entry.Path)
+		}
+	}
+	return manifest
+}
+
+func validManifestPathOrDie(path string) {
+	if !filepath.IsLocal(path) || path != filepath.Clean(path) {
+		log.Fatal("Change set path is absolute or incorrect: " + path)
+	}
+	fp.ValidFilePathForOrtoOrDie(path)
+}
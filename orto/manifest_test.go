@@ -0,0 +1,112 @@
+package orto_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+	"github.com/anknetau/orto/orto"
+)
+
+func testManifest() orto.Manifest {
+	return orto.Manifest{
+		Version:     orto.ManifestVersion,
+		OrtoVersion: orto.Version(),
+		Name:        "cs",
+		Created:     time.Date(2025, 9, 6, 12, 0, 0, 0, time.UTC),
+		Source:      orto.Provenance{Commit: fp.Checksum("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"), Remotes: []git.Remote{}},
+		Changes: []orto.ManifestEntry{
+			{Kind: orto.ChangeKindModified, Path: "src/main.go", Mode: git.ModeExecutable, Content: "worktree/src/main.go", BaseContent: "base/src/main.go"},
+			{Kind: orto.ChangeKindDeleted, Path: "old.txt", BaseContent: "base/old.txt"},
+		},
+		Index: []orto.IndexEntry{
+			{Path: "src/main.go", Mode: git.ModeFile, Checksum: fp.Checksum("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"), Content: "index/src/main.go"},
+			{Path: "old.txt", Mode: git.ModeDeleted},
+		},
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	var encoded bytes.Buffer
+	assert.Equal(t, nil, orto.EncodeManifest(&encoded, testManifest()))
+	manifest := orto.DecodeManifest(encoded.Bytes(), "cs.json")
+	assert.Equal(t, testManifest(), manifest)
+	assert.Equal(t, 1, manifest.Version)
+}
+
+func TestDecodeManifestRefuses(t *testing.T) {
+	decode := func(change func(manifest *orto.Manifest)) func() {
+		return func() {
+			manifest := testManifest()
+			change(&manifest)
+			var encoded bytes.Buffer
+			assert.Equal(t, nil, orto.EncodeManifest(&encoded, manifest))
+			orto.DecodeManifest(encoded.Bytes(), "cs.json")
+		}
+	}
+	expectFatal(t, "version", "Change set manifest cs.json has version 2, but only version 1 is supported", decode(func(manifest *orto.Manifest) {
+		manifest.Version = 2
+	}))
+	expectFatal(t, "path", "Change set path is absolute or incorrect: ../main.go", decode(func(manifest *orto.Manifest) {
+		manifest.Changes[0].Content = "../main.go"
+	}))
+	expectFatal(t, "base", "Change set path is absolute or incorrect: /base/old.txt", decode(func(manifest *orto.Manifest) {
+		manifest.Changes[1].BaseContent = "/base/old.txt"
+	}))
+	expectFatal(t, "index", "Change set index entry is incomplete: src/main.go", decode(func(manifest *orto.Manifest) {
+		manifest.Index[0].Content = ""
+	}))
+}
+
+func TestManifestEntryChange(t *testing.T) {
+	base := &git.Blob{CleanPath: "src/main.go", Path: "src/main.go", Checksum: fp.Checksum("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"), Mode: git.ModeExecutable, Size: 0}
+	worktree := &orto.FSFile{CleanPath: "src/main.go", Path: "src/main.go"}
+
+	// A modified file refers to its HEAD version, so that it can be merged
+	entry := orto.NewManifestEntry(orto.Change{Kind: orto.ChangeKindModified, GitBlob: base, FsFile: worktree, Checksum: "2e65efe2a145dda7ee51d1741299f848e5bf752e"})
+	assert.Equal(t, base.Checksum, entry.GitChecksum)
+	assert.Equal(t, git.ModeExecutable, entry.GitMode)
+	change := entry.Change()
+	assert.Equal(t, *base, *change.GitBlob)
+	assert.Equal(t, *worktree, *change.FsFile)
+	assert.Equal(t, fp.Checksum("2e65efe2a145dda7ee51d1741299f848e5bf752e"), change.Checksum)
+
+	change = orto.NewManifestEntry(orto.Change{Kind: orto.ChangeKindDeleted, GitBlob: base}).Change()
+	assert.Equal(t, *base, *change.GitBlob)
+	assert.True(t, change.FsFile == nil)
+	change = orto.NewManifestEntry(orto.Change{Kind: orto.ChangeKindAdded, FsFile: worktree}).Change()
+	assert.True(t, change.GitBlob == nil)
+	assert.Equal(t, *worktree, *change.FsFile)
+}
+
+func TestNewIndexEntry(t *testing.T) {
+	entry := orto.NewIndexEntry(git.IndexChange{Path: "new.go", OrigPath: "old.go", Status: "R.", Mode: git.ModeFile, Checksum: "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"})
+	assert.Equal(t, orto.IndexEntry{Path: "new.go", OrigPath: "old.go", Status: "R.", Mode: git.ModeFile, Checksum: "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"}, entry)
+	assert.False(t, entry.IsDeleted())
+	// git gives a zero checksum for a staged deletion, which isn't kept
+	entry = orto.NewIndexEntry(git.IndexChange{Path: "old.go", Status: "D.", Mode: git.ModeDeleted, Checksum: "0000000000000000000000000000000000000000"})
+	assert.Equal(t, orto.IndexEntry{Path: "old.go", Status: "D.", Mode: git.ModeDeleted}, entry)
+	assert.True(t, entry.IsDeleted())
+}
+
+func TestProvenanceBase(t *testing.T) {
+	head := fp.Checksum("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+	base := fp.Checksum("4277b6e69d25e5efa77c455340557b384a4c018a")
+	headers := git.StatusHeaders{Oid: head, Head: "main"}
+
+	// Comparing with HEAD, by any name, records nothing more
+	provenance := orto.NewProvenance(git.Env{}, headers, nil, "main", head)
+	assert.Equal(t, "", provenance.BaseRevision)
+	assert.Equal(t, fp.Checksum(""), provenance.Base)
+	assert.Equal(t, head, provenance.BaseCommit())
+	assert.Equal(t, 0, len(provenance.Remotes))
+
+	provenance = orto.NewProvenance(git.Env{}, headers, nil, "origin/main", base)
+	assert.Equal(t, "origin/main", provenance.BaseRevision)
+	assert.Equal(t, base, provenance.Base)
+	assert.Equal(t, base, provenance.BaseCommit())
+	assert.Equal(t, head, provenance.Commit)
+}
@@ -1,22 +1,27 @@
 package orto
 
 import (
+	"iter"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/anknetau/orto/fp"
 	"github.com/anknetau/orto/git"
 )
 
 type Catalog struct {
-	fsFiles              []FSFile
-	gitBlobs             []git.Blob
+	fsFiles              iter.Seq[FSFile]   // Walked while diffing
+	gitBlobs             iter.Seq[git.Blob] // Listed while diffing
 	gitStatus            []git.StatusLine
-	gitSubmodules        []git.Submodule
-	fsFileIndex          map[string]FSFile
-	gitBlobIndex         map[string]git.Blob
+	gitHeaders           git.StatusHeaders
+	gitIndexChanges      []git.IndexChange
+	gitIndexSecrets      map[string][]SecretFinding // What looks like secrets in the staged versions, by path
+	gitRemotes           []git.Remote
 	gitIgnoredFilesIndex map[string]string
+	gitStatusPaths       git.StatusPaths
 	envConfig            fp.EnvConfig
 }
 
@@ -27,21 +32,38 @@ type Settings struct {
 	gitEnv    git.Env
 }
 type InputSettings struct {
-	copyDotGit bool
+	copyDotGit      bool
+	ignores         *PathMatcher
+	includes        *PathMatcher         // If not empty, only what matches is saved
+	gitIgnored      *gitIgnoredSelection // Which files that git ignores are copied, or nil for none
+	secrets         *SecretScanner       // Or nil when not scanning
+	secretAction    SecretAction
+	concurrency     int
+	paranoid        bool
+	absExcludedFile string // The output, when it is a single file that could be inside the worktree
+	baseRevision    string
+	baseCommit      fp.Checksum // What baseRevision resolved to
+	baseIsHead      bool
+	fileModes       bool // git's core.fileMode, ie whether the executable bit is compared
 }
 
 type OutputSettings struct {
-	absDestinationDir               string
-	absDestinationChangeSetDir      string
-	absDestinationChangeSetJsonFile string
-	copyUnchangedFiles              bool
+	absDestinationDir  string
+	absDestinationFile string // When the output is a single file, eg a zip
+	format             OutputFormat
+	changeSetName      string
+	startTime          time.Time
+	copyUnchangedFiles bool
+	encryption         Encryption
 }
 
 func Run(params UserParameters) {
 	settings := applyDefaultsAndCheckParameters(&params)
+	defer settings.gitEnv.Close()
 	catalog := find(settings.input, settings.gitEnv)
+	catalog.gitIndexSecrets = findStagedSecrets(catalog.gitIndexChanges, settings.input.secrets, settings.gitEnv)
 	changes := diff(catalog, settings.input, settings.gitEnv)
-	write(settings.gitEnv, settings.output, changes)
+	write(settings, catalog, changes)
 }
 
 func find(inputSettings InputSettings, gitEnv git.Env) Catalog {
@@ -54,22 +76,31 @@ func find(inputSettings InputSettings, gitEnv git.Env) Catalog {
 	if err != nil {
 		log.Fatal(err)
 	}
-	gitBlobs, gitSubmodules := git.RunGetTreeForHead(gitEnv)
 	inputs := Catalog{
-		fsFiles:       FsReadDir(absSourceDir),
-		gitBlobs:      gitBlobs,
-		gitStatus:     git.RunStatus(gitEnv),
-		gitSubmodules: gitSubmodules,
+		fsFiles: FsWalk(absSourceDir, inputSettings.absExcludedFile),
+		gitBlobs: func(yield func(git.Blob) bool) {
+			// Submodules are not compared
+			for gitBlob := range git.RunStreamTree(gitEnv, inputSettings.baseCommit) {
+				if gitBlob != nil && !yield(*gitBlob) {
+					return
+				}
+			}
+		},
+		gitStatus:  git.RunStatus(gitEnv),
+		gitRemotes: gitEnv.RunGetRemotes(),
+	}
+	inputs.gitHeaders = git.NewStatusHeaders(inputs.gitStatus)
+	inputs.gitIndexChanges = git.IndexChanges(inputs.gitStatus)
+	inputs.gitStatusPaths = git.NewStatusPaths(inputs.gitStatus)
+	if inputs.gitHeaders.Detached {
+		PrintLogHeader("HEAD is detached at " + string(inputs.gitHeaders.Oid))
+	} else {
+		PrintLogHeader("On branch " + inputs.gitHeaders.Head + " at " + string(inputs.gitHeaders.Oid))
 	}
-	inputs.fsFileIndex = Index(inputs.fsFiles, func(file FSFile) string {
-		return file.CleanPath
-	})
-	inputs.gitBlobIndex = Index(inputs.gitBlobs, func(file git.Blob) string {
-		return file.CleanPath
-	})
-
 	var gitIgnoredFiles = Filter(inputs.gitStatus, func(statusLine *git.StatusLine) *string {
-		git.PrintStatusLine(statusLine)
+		if verbosity >= VerbosityVerbose {
+			git.PrintStatusLine(statusLine)
+		}
 		if val, ok := (*statusLine).(git.IgnoredStatusLine); ok {
 			return &val.Path
 		}
@@ -79,121 +110,169 @@ func find(inputSettings InputSettings, gitEnv git.Env) Catalog {
 	return inputs
 }
 
-func diff(catalog Catalog, inputSettings InputSettings, gitEnv git.Env) []Change {
+// diff compares HEAD with the worktree as both are read, yielding the changes in git's order. Files are hashed
+// concurrently, and only a few at a time are held in memory.
+func diff(catalog Catalog, inputSettings InputSettings, gitEnv git.Env) iter.Seq[Change] {
 	PrintLogHeader("Comparing...")
-	common, fsFiles, gitBlobs := CompareFiles(catalog.gitBlobs, catalog.fsFiles, catalog.fsFileIndex, catalog.gitBlobIndex)
-
-	// TODO: is this happening or not?
-	// Filter out ignored
-	//var aLeft []FSFile
-	//for _, fsFile := range fsFiles {
-	//	if _, found := gitIgnoredFilesIndex[fsFile.filepath]; !found {
-	//		aLeft = append(aLeft, fsFile)
-	//	}
-	//}
-
-	hasher, err := git.NewHasher(gitEnv.PathToBinary)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func(hasher *git.Hasher) {
-		_ = hasher.Close()
-	}(hasher)
-
-	var changes []Change
-	for _, fsFile := range fsFiles {
-		change := ComparePair(nil, &fsFile, catalog.gitIgnoredFilesIndex, inputSettings, gitEnv, hasher)
-		changes = append(changes, change)
-	}
-	for _, blob := range gitBlobs {
-		change := ComparePair(&blob, nil, catalog.gitIgnoredFilesIndex, inputSettings, gitEnv, hasher)
-		changes = append(changes, change)
-	}
-	for _, gitBlobAndFile := range common {
-		change := ComparePair(&gitBlobAndFile.GitBlob, &gitBlobAndFile.FsFile, catalog.gitIgnoredFilesIndex, inputSettings, gitEnv, hasher)
-		changes = append(changes, change)
+	for _, indexChange := range catalog.gitIndexChanges {
+		PrintIndexChange(indexChange)
+		reportSecrets(indexChange.Path+" (staged)", catalog.gitIndexSecrets[indexChange.Path], inputSettings.secretAction)
 	}
-
-	for _, c := range changes {
-		if c.Kind == ChangeKindAdded || c.Kind == ChangeKindModified || c.Kind == ChangeKindDeleted {
-			PrintChange(c)
-		}
-	}
-	for _, c := range changes {
-		if c.Kind == ChangeKindUnchanged {
-			PrintChange(c)
+	return func(yield func(Change) bool) {
+		hasher, err := gitEnv.NewWorktreeHasher()
+		if err != nil {
+			log.Fatal(err)
 		}
-	}
-	for _, c := range changes {
-		if c.Kind == ChangeKindIgnoredByGit {
-			PrintChange(c)
+		defer func(hasher *git.WorktreeHasher) {
+			_ = hasher.Close()
+		}(hasher)
+
+		var statusPaths *git.StatusPaths
+		if !inputSettings.paranoid {
+			statusPaths = &catalog.gitStatusPaths
 		}
-	}
 
-	ortoDotGitIgnores := 0
-	for _, c := range changes {
-		validateChange(c)
-		// TODO: should ignored files by orto refer just to FsFiles? can i not ignore files in git?
-		// or am i ignoring changes?
-		if c.Kind == ChangeKindIgnoredByOrto {
-			if gitEnv.IsPartOfDotGit(c.FsFile.CleanPath) {
+		ortoDotGitIgnores := 0
+		pairs := MergeFiles(catalog.gitBlobs, catalog.fsFiles)
+		for c := range ParallelMapSeq(pairs, inputSettings.concurrency, func(p FilePair) Change {
+			change := ComparePair(p.GitBlob, p.FsFile, catalog.gitIgnoredFilesIndex, inputSettings, gitEnv, hasher, statusPaths)
+			change.Secrets = findSecrets(change, inputSettings.secrets)
+			return change
+		}) {
+			validateChange(c)
+			if c.Kind == ChangeKindIgnoredByOrto && gitEnv.IsPartOfDotGit(changePath(c)) {
 				ortoDotGitIgnores++
 			}
-		}
-	}
-	if ortoDotGitIgnores > 0 && !inputSettings.copyDotGit {
-		println("⛔︎ OrtoIgnored", ".git/**")
-	}
-	for _, c := range changes {
-		if c.Kind == ChangeKindIgnoredByOrto {
 			PrintChange(c)
+			if len(c.Secrets) > 0 {
+				reportSecrets(c.FsFile.CleanPath, c.Secrets, inputSettings.secretAction)
+			}
+			if c.Kind == ChangeKindIgnoredByGit && c.Checksum == "" && inputSettings.gitIgnored != nil {
+				if _, tooLarge := inputSettings.gitIgnored.selects(c.FsFile); tooLarge {
+					printLog("  ⚠️ Not copying", c.FsFile.CleanPath, "as it is larger than", inputSettings.gitIgnored.maxSize, "bytes")
+				}
+			}
+			if !yield(c) {
+				return
+			}
+		}
+		if ortoDotGitIgnores > 0 && !inputSettings.copyDotGit {
+			printLog("⛔︎ OrtoIgnored", ".git/**")
 		}
 	}
+}
 
-	return changes
+// reportSecrets logs what looks like secrets in a file, and stops if they are refused.
+func reportSecrets(what string, findings []SecretFinding, action SecretAction) {
+	for _, finding := range findings {
+		printLog("  🔑 Possible secret in", what+":", finding.String())
+	}
+	if len(findings) > 0 && action == SecretsRefuse {
+		log.Fatalf("Not saving %s, as it looks like it holds a secret. Ignore it, or encrypt it with -Secrets encrypt", what)
+	}
 }
 
-func write(gitEnv git.Env, outputSettings OutputSettings, changes []Change) {
+// write writes the changes as they are yielded, and then the manifest.
+func write(settings Settings, catalog Catalog, changes iter.Seq[Change]) {
+	gitEnv := settings.gitEnv
+	outputSettings := settings.output
+	if settings.input.secretAction == SecretsRefuse {
+		// Every file is scanned before anything is written, so that refusing one leaves nothing behind
+		changes = slices.Values(slices.Collect(changes))
+	}
 	PrintLogHeader("Writing output...")
 
-	// TODO: do this properly:
-	err := os.Mkdir(outputSettings.absDestinationChangeSetDir, 0755)
-	if err != nil {
-		log.Fatal(err)
+	source := NewProvenance(gitEnv, catalog.gitHeaders, catalog.gitRemotes, settings.input.baseRevision, settings.input.baseCommit)
+	writer := newOutputWriter(OutputContext{
+		GitEnv:          gitEnv,
+		Format:          outputSettings.format,
+		DestinationDir:  outputSettings.absDestinationDir,
+		DestinationFile: outputSettings.absDestinationFile,
+		ChangeSetName:   outputSettings.changeSetName,
+		StartTime:       outputSettings.startTime,
+		Encryption:      outputSettings.encryption,
+		Source:          source,
+	})
+	writeOrDie(writer.Begin())
+
+	manifest := Manifest{
+		Version:     ManifestVersion,
+		OrtoVersion: Version(),
+		Name:        outputSettings.changeSetName,
+		Created:     settings.envConfig.StartTime,
+		Source:      source,
+		Changes:     []ManifestEntry{},
+		Index:       make([]IndexEntry, 0, len(catalog.gitIndexChanges)),
 	}
 
-	jsonOut := JsonOutput{absDestinationChangeSetJsonFile: outputSettings.absDestinationChangeSetJsonFile}
-	defer jsonOut.close()
-	jsonOut.start()
+	// With -Secrets encrypt, every copy of a path is encrypted if any version of it looks like it holds a secret
+	secretPaths := make(map[string]bool)
+	for path := range catalog.gitIndexSecrets {
+		secretPaths[path] = true
+	}
+	encryptsSecretPath := func(path string) bool {
+		return outputSettings.encryption.Secrets && secretPaths[path]
+	}
+	copyFromWorktree := func(change Change, entry *ManifestEntry) {
+		entry.Encrypted = encryptsSecretPath(entry.Path)
+		writeOrDie(writer.PutWorktreeFile(change, entry))
+		PrintLogCopy(change.FsFile.CleanPath, writer.Location(entry.Content))
+	}
 
-	for _, change := range changes {
+	// The staged version of a path is encrypted whenever its worktree version would be
+	worktreeChanges := make(map[string]Change)
+	for change := range changes {
+		entry := NewManifestEntry(change)
+		worktreeChanges[entry.Path] = change
+		if len(change.Secrets) > 0 {
+			secretPaths[entry.Path] = true
+		}
 		//fmt.Printf("%#v,%#v\n", change.FsFile, change.GitBlob)
 		switch change.Kind {
 		case ChangeKindAdded:
-			CopyFile(change.FsFile.CleanPath, change.FsFile.CleanPath, outputSettings.absDestinationChangeSetDir)
-			PrintLogCopy(change.FsFile.CleanPath, filepath.Join(outputSettings.absDestinationChangeSetDir, change.FsFile.CleanPath))
+			copyFromWorktree(change, &entry)
 		case ChangeKindModified:
-			// TODO: copy the old file too
-			CopyFile(change.FsFile.CleanPath, change.FsFile.CleanPath, outputSettings.absDestinationChangeSetDir)
-			PrintLogCopy(change.FsFile.CleanPath, filepath.Join(outputSettings.absDestinationChangeSetDir, change.FsFile.CleanPath))
+			copyFromWorktree(change, &entry)
+			writeOrDie(writer.PutBaseBlob(change, &entry))
 		case ChangeKindDeleted:
-			SaveGitBlob(gitEnv, change.GitBlob.Checksum, change.GitBlob.CleanPath, outputSettings.absDestinationChangeSetDir)
-			jsonOut.maybeAddComma() // TODO: finish this
-			jsonOut.encode(change.GitBlob)
+			entry.Encrypted = encryptsSecretPath(entry.Path)
+			writeOrDie(writer.PutBaseBlob(change, &entry))
+			writeOrDie(writer.RecordDeletion(change, &entry))
 			PrintLogDel(change.GitBlob.CleanPath)
 		case ChangeKindUnchanged:
 			if outputSettings.copyUnchangedFiles {
-				CopyFile(change.FsFile.CleanPath, change.FsFile.CleanPath, outputSettings.absDestinationChangeSetDir)
-				PrintLogCopy(change.FsFile.CleanPath, filepath.Join(outputSettings.absDestinationChangeSetDir, change.FsFile.CleanPath))
+				copyFromWorktree(change, &entry)
 			}
 		case ChangeKindIgnoredByGit:
-			// TODO
+			// Only the files selected to be copied were hashed
+			if change.Checksum != "" {
+				copyFromWorktree(change, &entry)
+			}
 		case ChangeKindIgnoredByOrto:
 			// TODO
 		}
+		manifest.Changes = append(manifest.Changes, entry)
 	}
 
-	PrintLogHeader("Written " + outputSettings.absDestinationChangeSetJsonFile)
+	for _, indexChange := range catalog.gitIndexChanges {
+		entry := NewIndexEntry(indexChange)
+		entry.Secrets = catalog.gitIndexSecrets[indexChange.Path]
+		if !indexChange.IsDeleted() {
+			change, found := worktreeChanges[indexChange.Path]
+			if !found {
+				// Staged and then removed from the worktree, so it is in neither HEAD nor the worktree
+				change = Change{Kind: ChangeKindAdded}
+			}
+			entry.Encrypted = encryptsSecretPath(indexChange.Path) || outputSettings.encryption.encryptsFile(change)
+			entry.Size = gitEnv.RunGetObjectSize(indexChange.Checksum)
+			writeOrDie(writer.PutIndexBlob(indexChange, &entry))
+			PrintLogCopy("(index) "+indexChange.Path, writer.Location(entry.Content))
+		}
+		manifest.Index = append(manifest.Index, entry)
+	}
+
+	writeOrDie(writer.Finish(manifest))
+	PrintLogHeader("Written " + writer.Location(""))
 
 	PrintLogHeader("Finished")
 }
@@ -226,8 +305,8 @@ func validateChange(c Change) {
 			panic("Illegal state")
 		}
 	case ChangeKindIgnoredByOrto:
-		// Only FSFile
-		if c.FsFile == nil || c.GitBlob != nil {
+		// Only FSFile, or only blob when a file that orto ignores was deleted
+		if (c.FsFile == nil) == (c.GitBlob == nil) {
 			panic("Illegal state")
 		}
 	}
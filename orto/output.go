@@ -0,0 +1,115 @@
+package orto
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anknetau/orto/git"
+)
+
+// OutputWriter receives a change set during the write phase and stores it in some format. The methods are called in
+// order: Begin, then the Put and Record methods for each change, then Finish with the complete manifest. The Put and
+// Record methods may fill in the content fields of the entry they are given, which then end up in the manifest.
+type OutputWriter interface {
+	Begin() error
+	// PutWorktreeFile stores the worktree version of an added, modified or unchanged file. The working directory is the
+	// root of the worktree.
+	PutWorktreeFile(change Change, entry *ManifestEntry) error
+	// PutBaseBlob stores the HEAD version of a modified or deleted file, from git.
+	PutBaseBlob(change Change, entry *ManifestEntry) error
+	// RecordDeletion notes a file that was deleted from the worktree, after its PutBaseBlob.
+	RecordDeletion(change Change, entry *ManifestEntry) error
+	// PutIndexBlob stores the staged version of a file, from git. Staged deletions are only in the manifest.
+	PutIndexBlob(indexChange git.IndexChange, entry *IndexEntry) error
+	Finish(manifest Manifest) error
+	// Location describes where a path in the output ends up, eg the Content of an entry, or where the whole output
+	// does for an empty path, for logging.
+	Location(path string) string
+}
+
+// OutputContext is what an OutputWriter is created with.
+type OutputContext struct {
+	GitEnv          git.Env
+	Format          OutputFormat
+	DestinationDir  string // Absolute
+	DestinationFile string // Absolute. Only for formats that write a single file
+	ChangeSetName   string
+	StartTime       time.Time
+	Encryption      Encryption // Only for formats that hold a copy of every file
+	Source          Provenance
+}
+
+// ChangeSetDir is the directory that a change set named ChangeSetName gets in DestinationDir.
+func (ctx OutputContext) ChangeSetDir() string {
+	return filepath.Join(ctx.DestinationDir, ctx.ChangeSetName)
+}
+
+// ManifestFile is where the manifest goes next to ChangeSetDir.
+func (ctx OutputContext) ManifestFile() string {
+	return filepath.Join(ctx.DestinationDir, ctx.ChangeSetName+".json")
+}
+
+type OutputWriterFactory func(ctx OutputContext) OutputWriter
+
+// OutputTarget is what an output format writes to.
+type OutputTarget int
+
+const (
+	OutputTargetDirectory  OutputTarget = iota // An empty directory
+	OutputTargetFile                           // A new file, named with the format's Extension
+	OutputTargetRepository                     // A bare git repository named with the format's Extension, created if needed
+)
+
+type outputFormatRegistration struct {
+	target  OutputTarget
+	factory OutputWriterFactory
+}
+
+var outputFormats = map[OutputFormat]outputFormatRegistration{}
+
+// RegisterOutputFormat makes a format available for writing change sets. Formats that don't target a directory are
+// picked for destinations ending in their Extension.
+func RegisterOutputFormat(format OutputFormat, target OutputTarget, factory OutputWriterFactory) {
+	if format == "" || strings.ContainsAny(string(format), "/\\ ") {
+		log.Fatalf("Invalid output format name '%s'", format)
+	}
+	if _, found := outputFormats[format]; found {
+		log.Fatalf("Output format %s registered twice", format)
+	}
+	outputFormats[format] = outputFormatRegistration{target: target, factory: factory}
+}
+
+// UnregisterOutputFormat removes a format that RegisterOutputFormat added, eg one registered for a test.
+func UnregisterOutputFormat(format OutputFormat) {
+	delete(outputFormats, format)
+}
+
+// OutputFormats lists the registered formats, sorted by name.
+func OutputFormats() []OutputFormat {
+	result := make([]OutputFormat, 0, len(outputFormats))
+	for format := range outputFormats {
+		result = append(result, format)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+func (format OutputFormat) Target() OutputTarget {
+	return outputFormats[format].target
+}
+
+func (format OutputFormat) IsRegistered() bool {
+	_, found := outputFormats[format]
+	return found
+}
+
+func newOutputWriter(ctx OutputContext) OutputWriter {
+	registration, found := outputFormats[ctx.Format]
+	if !found {
+		panic("Unknown output format " + string(ctx.Format))
+	}
+	return registration.factory(ctx)
+}
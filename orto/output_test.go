@@ -0,0 +1,37 @@
+package orto_test
+
+import (
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/orto"
+)
+
+func TestOutputFormatOfDestination(t *testing.T) {
+	assert.Equal(t, orto.OutputFormatDirectory, orto.OutputFormatOfDestination("/tmp/out"))
+	assert.Equal(t, orto.OutputFormatZip, orto.OutputFormatOfDestination("/tmp/out.ZIP"))
+	assert.Equal(t, orto.OutputFormatTar, orto.OutputFormatOfDestination("out.tar"))
+	assert.Equal(t, orto.OutputFormatTarGz, orto.OutputFormatOfDestination("out.tar.gz"))
+	assert.Equal(t, orto.OutputFormatTarZstd, orto.OutputFormatOfDestination("out.tar.zst"))
+	assert.Equal(t, orto.OutputFormatDirectory, orto.OutputFormatOfDestination("out.gz"))
+}
+
+type nullWriter struct {
+	orto.OutputWriter
+}
+
+func TestRegisterOutputFormat(t *testing.T) {
+	format := orto.OutputFormat("test.null")
+	assert.False(t, format.IsRegistered())
+	t.Cleanup(func() { orto.UnregisterOutputFormat(format) })
+	orto.RegisterOutputFormat(format, orto.OutputTargetFile, func(ctx orto.OutputContext) orto.OutputWriter {
+		return nullWriter{}
+	})
+	assert.True(t, format.IsRegistered())
+	assert.True(t, format.IsFile())
+	assert.Equal(t, ".test.null", format.Extension())
+	assert.Equal(t, format, orto.OutputFormatOfDestination("out.test.null"))
+	assert.False(t, orto.OutputFormatDirectory.IsFile())
+	orto.UnregisterOutputFormat(format)
+	assert.False(t, format.IsRegistered())
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
@@ -19,37 +20,204 @@ type UserParameters struct {
 	ChangeSetName       string
 	PathToGitBinary     string
 	CopyDotGit          bool
-	CopyGitIgnoredFiles bool // TODO
+	CopyGitIgnoredFiles bool
 	CopyUnchangedFiles  bool
+	Format              OutputFormat // Default: inferred from the destination, see OutputFormatOfDestination
+	Concurrency         int          // How many files to hash at once. Default: the number of CPUs
+	Paranoid            bool         // Hash every file, instead of trusting git's index for those it says are clean
+	BaseRevision        string       // What the worktree is compared with, eg "origin/main" or a tag. Default: HEAD
+	Ignore              []string     // Paths that are never saved, in the syntax of .ortoignore, eg "vendor/"
+	Include             []string     // If not empty, only the paths that match are saved
+	GitIgnoredInclude   []string     // If not empty, only the files git ignores that match are copied, eg ".env*"
+	GitIgnoredExclude   []string     // Files git ignores that are never copied. Default: DefaultGitIgnoredExcludes
+	GitIgnoredMaxSize   int64        // The largest file git ignores that is copied, in bytes. Default: 1 MiB
+	Encrypt             EncryptScope // Which files are encrypted. Default: none
+	Recipients          []string     // age public keys to encrypt for, eg "age1..."
+	Passphrase          string       // To encrypt with instead of recipients
+	Secrets             SecretAction // What to do with files that look like they hold secrets. Default: report
+	SecretRules         []SecretRule // Used besides BuiltinSecretRules
+	Config              Config       // Settings given explicitly, eg on the command line, that win over configuration files
 	// TODO: CopyContentsOfSubmodules? Do we need to diff those too, recursively?
 }
 
-func setDefaultStringIfEmpty(key *string, def string) {
-	if *key == "" {
-		*key = def
+type OutputFormat string
+
+const (
+	OutputFormatDirectory OutputFormat = "dir"
+	OutputFormatZip       OutputFormat = "zip"
+	OutputFormatTar       OutputFormat = "tar"
+	OutputFormatTarGz     OutputFormat = "tar.gz"
+	OutputFormatTarBz2    OutputFormat = "tar.bz2"
+	OutputFormatTarZstd   OutputFormat = "tar.zst"
+	OutputFormatTarXz     OutputFormat = "tar.xz"
+	OutputFormatPatch     OutputFormat = "patch"
+	OutputFormatGitRepo   OutputFormat = "git"
+	OutputFormatBundle    OutputFormat = "bundle"
+)
+
+// OutputFormatOfDestination infers the output format from the destination: a path ending in the extension of a
+// format that writes a file or a repository is one of those, anything else is a directory.
+func OutputFormatOfDestination(path string) OutputFormat {
+	result := OutputFormatDirectory
+	for _, format := range OutputFormats() {
+		// The longest extension wins, eg ".tar.gz" over a hypothetical ".gz"
+		if format.Extension() != "" && strings.HasSuffix(strings.ToLower(path), format.Extension()) &&
+			len(format.Extension()) > len(result.Extension()) {
+			result = format
+		}
+	}
+	return result
+}
+
+// IsFile is true for formats that write a single file rather than a directory.
+func (format OutputFormat) IsFile() bool {
+	return format.Target() == OutputTargetFile
+}
+
+func (format OutputFormat) Extension() string {
+	if format.Target() == OutputTargetDirectory {
+		return ""
+	}
+	return "." + string(format)
+}
+
+// IsTar is true for tar archives, compressed or not.
+func (format OutputFormat) IsTar() bool {
+	return format == OutputFormatTar || strings.HasPrefix(string(format), string(OutputFormatTar)+".")
+}
+
+// Resolve fills in what is not set, from the fields that are set, then Config, then the configuration files of the
+// source's worktree and of the user, then the defaults. A format from a configuration file is only used if the
+// destination doesn't imply one.
+func (params *UserParameters) Resolve(absSourceDir string) {
+	explicit := params.explicitConfig().Over(params.Config)
+	config := LoadConfig(explicit, absSourceDir)
+	params.Ignore = config.Ignore
+	params.Include = config.Include
+	if config.Destination != nil {
+		params.Destination = *config.Destination
+	}
+	if explicit.Format != nil {
+		params.Format = *explicit.Format
+	} else if config.Format != nil && OutputFormatOfDestination(params.Destination) == OutputFormatDirectory {
+		params.Format = *config.Format
+	}
+	params.PathToGitBinary = *config.PathToGitBinary
+	params.CopyDotGit = *config.CopyDotGit
+	params.CopyGitIgnoredFiles = *config.CopyGitIgnoredFiles
+	params.CopyUnchangedFiles = *config.CopyUnchangedFiles
+	params.GitIgnoredInclude = config.GitIgnoredInclude
+	params.GitIgnoredExclude = config.GitIgnoredExclude
+	params.GitIgnoredMaxSize = *config.GitIgnoredMaxSize
+	params.Encrypt = *config.Encrypt
+	params.Recipients = config.Recipients
+	params.Secrets = *config.Secrets
+	params.SecretRules = config.SecretRules
+	if len(params.BaseRevision) == 0 {
+		params.BaseRevision = "HEAD"
+	}
+	if params.Concurrency <= 0 {
+		params.Concurrency = runtime.GOMAXPROCS(0)
 	}
 }
 
-func (params *UserParameters) ApplyDefaults() {
-	setDefaultStringIfEmpty(&params.PathToGitBinary, "git")
+// explicitConfig is the layer of the fields that are set. A false bool is the same as unset.
+func (params *UserParameters) explicitConfig() Config {
+	config := Config{
+		Ignore:            params.Ignore,
+		Include:           params.Include,
+		GitIgnoredInclude: params.GitIgnoredInclude,
+		GitIgnoredExclude: params.GitIgnoredExclude,
+		Recipients:        params.Recipients,
+		SecretRules:       params.SecretRules,
+	}
+	if params.Format != "" {
+		config.Format = &params.Format
+	}
+	if params.Destination != "" {
+		config.Destination = &params.Destination
+	}
+	if params.PathToGitBinary != "" {
+		config.PathToGitBinary = &params.PathToGitBinary
+	}
+	if params.CopyDotGit {
+		config.CopyDotGit = &params.CopyDotGit
+	}
+	if params.CopyGitIgnoredFiles {
+		config.CopyGitIgnoredFiles = &params.CopyGitIgnoredFiles
+	}
+	if params.CopyUnchangedFiles {
+		config.CopyUnchangedFiles = &params.CopyUnchangedFiles
+	}
+	if params.Encrypt != "" {
+		config.Encrypt = &params.Encrypt
+	}
+	if params.Secrets != "" {
+		config.Secrets = &params.Secrets
+	}
+	if params.GitIgnoredMaxSize > 0 {
+		config.GitIgnoredMaxSize = &params.GitIgnoredMaxSize
+	}
+	return config
 }
 
 func applyDefaultsAndCheckParameters(params *UserParameters) Settings {
-	params.ApplyDefaults()
 	startTime := time.Now()
 
 	absSourceDir := CheckSourceDirectory(params.Source)
+	params.Resolve(absSourceDir)
 
 	gitEnv := git.Find(params.PathToGitBinary, absSourceDir)
 	PrintLogHeader("Found git version " + gitEnv.Version + " with algo " + string(gitEnv.Algo))
 	PrintLogHeader("Repository worktree is '" + gitEnv.AbsRoot + "' with .git at '" + gitEnv.AbsGitDir + "'")
 
-	absDestinationDir := CheckDestinationDirectory(params.Destination)
-	PrintLogHeader("Destination is '" + absDestinationDir + "'")
+	baseCommit, found := gitEnv.RunResolveCommit(params.BaseRevision)
+	if !found {
+		log.Fatalf("Unknown base revision %s", params.BaseRevision)
+	}
+	PrintLogHeader("Base revision " + params.BaseRevision + " is " + string(baseCommit))
 
-	// TODO: this is unsupported for now, but will change in the future - if eg the target is a compressed file
-	if !fp.AbsolutePathsAreUnrelated(gitEnv.AbsRoot, absDestinationDir) {
-		log.Fatalf("Source and destination are related: %s and %s", params.Source, params.Destination)
+	if params.Format == "" {
+		params.Format = OutputFormatOfDestination(params.Destination)
+	} else if !params.Format.IsRegistered() {
+		log.Fatalf("Unknown output format %s", params.Format)
+	}
+	format := params.Format
+	// Only a repository has a default destination, see CheckDestinationRepository
+	if len(params.Destination) == 0 && format.Target() != OutputTargetRepository {
+		log.Fatal("No destination was given, and none is configured")
+	}
+	if !params.Secrets.IsValid() {
+		log.Fatalf("Unknown secrets action %s", params.Secrets)
+	}
+	encryption := NewEncryption(params.Encrypt, params.Recipients, params.Passphrase, params.Secrets)
+	if (encryption.Scope != EncryptNone || encryption.Secrets) && format == OutputFormatPatch {
+		log.Fatal("A patch can't be encrypted, as it holds the changes rather than the files")
+	}
+	var absDestinationDir, absDestinationFile string
+	if format.Target() == OutputTargetRepository {
+		absDestinationDir = CheckDestinationRepository(params.Destination, gitEnv)
+		PrintLogHeader("Destination is repository '" + absDestinationDir + "'")
+	} else if format.IsFile() {
+		absDestinationFile = CheckDestinationFile(params.Destination)
+		absDestinationDir = filepath.Dir(absDestinationFile)
+		PrintLogHeader("Destination is '" + absDestinationFile + "'")
+		// A single file can live inside the worktree, as the walk skips it, but never in .git
+		if fp.AbsolutePathIsParentOrEqual(gitEnv.AbsGitDir, absDestinationFile) {
+			log.Fatalf("Destination is inside .git: %s", params.Destination)
+		}
+	} else {
+		absDestinationDir = CheckDestinationDirectory(params.Destination)
+		PrintLogHeader("Destination is '" + absDestinationDir + "'")
+		if !fp.AbsolutePathsAreUnrelated(gitEnv.AbsRoot, absDestinationDir) {
+			log.Fatalf("Source and destination are related: %s and %s", params.Source, params.Destination)
+		}
+	}
+	if len(params.ChangeSetName) == 0 && format.IsFile() {
+		params.ChangeSetName = filepath.Base(absDestinationFile)
+		if strings.HasSuffix(strings.ToLower(params.ChangeSetName), format.Extension()) {
+			params.ChangeSetName = params.ChangeSetName[:len(params.ChangeSetName)-len(format.Extension())]
+		}
 	}
 	if len(params.ChangeSetName) == 0 {
 		params.ChangeSetName = util.SerializedDateTime(startTime)
@@ -61,13 +229,28 @@ func applyDefaultsAndCheckParameters(params *UserParameters) Settings {
 	}
 	return Settings{
 		input: InputSettings{
-			copyDotGit: params.CopyDotGit,
+			copyDotGit:      params.CopyDotGit,
+			ignores:         newIgnoreMatcher(params.Ignore, gitEnv.AbsRoot),
+			includes:        NewPathMatcher(ParsePathRules(params.Include), gitEnv.AbsRoot, ""),
+			gitIgnored:      newGitIgnoredSelection(params, gitEnv.AbsRoot),
+			secrets:         newSecretScanner(params),
+			secretAction:    params.Secrets,
+			concurrency:     params.Concurrency,
+			paranoid:        params.Paranoid,
+			absExcludedFile: absDestinationFile,
+			baseRevision:    params.BaseRevision,
+			baseCommit:      baseCommit,
+			baseIsHead:      baseCommit == gitEnv.RunGetHead(),
+			fileModes:       gitEnv.RunGetConfig("core.filemode") != "false",
 		},
 		output: OutputSettings{
-			absDestinationDir:               absDestinationDir,
-			absDestinationChangeSetJsonFile: filepath.Join(absDestinationDir, params.ChangeSetName+".json"),
-			absDestinationChangeSetDir:      filepath.Join(absDestinationDir, params.ChangeSetName),
-			copyUnchangedFiles:              params.CopyUnchangedFiles,
+			absDestinationDir:  absDestinationDir,
+			absDestinationFile: absDestinationFile,
+			format:             format,
+			changeSetName:      params.ChangeSetName,
+			startTime:          startTime,
+			copyUnchangedFiles: params.CopyUnchangedFiles,
+			encryption:         encryption,
 		},
 		envConfig: fp.EnvConfig{
 			StartTime: startTime,
@@ -76,6 +259,35 @@ func applyDefaultsAndCheckParameters(params *UserParameters) Settings {
 	}
 }
 
+// newIgnoreMatcher has the rules of the user's ignore file, then those in the settings, then those of the .ortoignore
+// files of the worktree.
+func newIgnoreMatcher(patterns []string, absRoot string) *PathMatcher {
+	var rules []PathRule
+	if absUserIgnoreFile := UserIgnoreFile(); absUserIgnoreFile != "" {
+		rules = ReadPathRules(absUserIgnoreFile, absUserIgnoreFile, "")
+	}
+	rules = append(rules, ParsePathRules(patterns)...)
+	return NewPathMatcher(rules, absRoot, IgnoreFileName)
+}
+
+func newGitIgnoredSelection(params *UserParameters, absRoot string) *gitIgnoredSelection {
+	if !params.CopyGitIgnoredFiles {
+		return nil
+	}
+	return &gitIgnoredSelection{
+		includes: NewPathMatcher(ParsePathRules(params.GitIgnoredInclude), absRoot, ""),
+		excludes: NewPathMatcher(ParsePathRules(params.GitIgnoredExclude), absRoot, ""),
+		maxSize:  params.GitIgnoredMaxSize,
+	}
+}
+
+func newSecretScanner(params *UserParameters) *SecretScanner {
+	if params.Secrets == SecretsOff {
+		return nil
+	}
+	return NewSecretScanner(params.SecretRules)
+}
+
 func CheckSourceDirectory(path string) string {
 	if len(path) == 0 {
 		log.Fatalf("Source '%s' is not a directory", path)
@@ -121,4 +333,47 @@ func CheckDestinationDirectory(path string) string {
 	return absDestinationDir
 }
 
+// CheckDestinationFile checks that a file can be created at the given path.
+func CheckDestinationFile(path string) string {
+	absDestinationFile, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = os.Lstat(absDestinationFile)
+	if err == nil {
+		log.Fatalf("Destination %s already exists", path)
+	} else if !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	fp.IsAbsPathToDirOrDie(filepath.Dir(absDestinationFile), "Destination's directory")
+	return absDestinationFile
+}
+
+// CheckDestinationRepository checks that a repository can be created or added to at the given path, which defaults to
+// ~/.orto/<name of the worktree>.git.
+func CheckDestinationRepository(path string, gitEnv git.Env) string {
+	if len(path) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		path = filepath.Join(home, ".orto", filepath.Base(gitEnv.AbsRoot)+OutputFormatGitRepo.Extension())
+	}
+	absDestinationDir, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stat, err := os.Stat(absDestinationDir)
+	if err == nil && !stat.IsDir() {
+		log.Fatalf("Destination '%s' is not a directory", path)
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if !fp.AbsolutePathsAreUnrelated(gitEnv.AbsRoot, absDestinationDir) ||
+		!fp.AbsolutePathsAreUnrelated(gitEnv.AbsGitDir, absDestinationDir) {
+		log.Fatalf("Source and destination are related: %s and %s", gitEnv.AbsRoot, path)
+	}
+	return absDestinationDir
+}
+
 // TODO: destination shouldn't be in source etc
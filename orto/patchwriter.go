@@ -0,0 +1,133 @@
+package orto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/anknetau/orto/git"
+	"github.com/anknetau/orto/patch"
+)
+
+// patchWriter writes the added, modified and deleted files of a change set as a single patch that git apply
+// understands. Unchanged files and the index are not part of it. Changes come in git's path order, as in git diff, so
+// each file is written as soon as both of its sides are known.
+type patchWriter struct {
+	ctx      OutputContext
+	pending  map[string]*patch.FilePatch // Modified and deleted files waiting for their other side
+	file     *os.File
+	buffered *bufio.Writer
+}
+
+func (w *patchWriter) Begin() error {
+	w.pending = make(map[string]*patch.FilePatch)
+	// O_EXCL as the destination was checked to not exist
+	f, err := os.OpenFile(w.ctx.DestinationFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.buffered = bufio.NewWriter(f)
+	source := w.ctx.Source
+	// git apply skips anything before the first "diff --git"
+	_, _ = fmt.Fprintf(w.buffered, "Change set %s created %s by orto %s\n", w.ctx.ChangeSetName, w.ctx.StartTime.Format("2006-01-02 15:04:05 -0700"), Version())
+	_, _ = fmt.Fprintf(w.buffered, "Source is %s at %s", source.Worktree, source.Commit)
+	if source.Branch != "" {
+		_, _ = fmt.Fprintf(w.buffered, " on branch %s", source.Branch)
+	}
+	if source.Base != "" {
+		_, _ = fmt.Fprintf(w.buffered, ", compared with %s at %s", source.BaseRevision, source.Base)
+	}
+	_, err = w.buffered.WriteString("\n\n")
+	return err
+}
+
+func (w *patchWriter) PutWorktreeFile(change Change, entry *ManifestEntry) error {
+	if change.Kind != ChangeKindAdded && change.Kind != ChangeKindModified {
+		return nil
+	}
+	content, err := readWorktreeContent(change.FsFile)
+	if err != nil {
+		return err
+	}
+	filePatch := &patch.FilePatch{
+		Path:        changePath(change),
+		NewMode:     entry.Mode,
+		NewChecksum: change.Checksum,
+		New:         content,
+	}
+	if change.Kind == ChangeKindAdded {
+		return w.add(filePatch)
+	}
+	w.pending[filePatch.Path] = filePatch
+	return nil
+}
+
+func (w *patchWriter) PutBaseBlob(change Change, entry *ManifestEntry) error {
+	var content bytes.Buffer
+	w.ctx.GitEnv.RunStreamRawContent(change.GitBlob.Checksum, &content)
+	filePatch, found := w.pending[change.GitBlob.CleanPath]
+	if !found {
+		filePatch = &patch.FilePatch{Path: change.GitBlob.CleanPath}
+		w.pending[filePatch.Path] = filePatch
+	}
+	filePatch.OldMode = change.GitBlob.Mode
+	filePatch.OldChecksum = change.GitBlob.Checksum
+	filePatch.Old = content.Bytes()
+	if change.Kind == ChangeKindModified {
+		delete(w.pending, filePatch.Path)
+		return w.add(filePatch)
+	}
+	return nil
+}
+
+func (w *patchWriter) RecordDeletion(change Change, entry *ManifestEntry) error {
+	filePatch, found := w.pending[change.GitBlob.CleanPath]
+	if !found {
+		panic("Illegal state: deletion without base " + change.GitBlob.CleanPath)
+	}
+	delete(w.pending, filePatch.Path)
+	return w.add(filePatch)
+}
+
+func (w *patchWriter) PutIndexBlob(git.IndexChange, *IndexEntry) error {
+	return nil
+}
+
+func (w *patchWriter) add(filePatch *patch.FilePatch) error {
+	return filePatch.Write(w.buffered)
+}
+
+func (w *patchWriter) Finish(Manifest) error {
+	if len(w.pending) > 0 {
+		panic("Illegal state: incomplete patches")
+	}
+	if err := w.buffered.Flush(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *patchWriter) Location(string) string {
+	// Everything is in the one file
+	return w.ctx.DestinationFile
+}
+
+// readWorktreeContent reads a file as git sees it, so the content of a symlink is its target.
+func readWorktreeContent(fsFile *FSFile) ([]byte, error) {
+	return readBlobContent(fsFile.Path)
+}
+
+// readBlobContent reads a file as git would store it, ie a symlink as its target.
+func readBlobContent(path string) ([]byte, error) {
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		return []byte(target), err
+	}
+	return os.ReadFile(path)
+}
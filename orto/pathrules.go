@@ -0,0 +1,247 @@
+package orto
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anknetau/orto/fp"
+)
+
+// IgnoreFileName is the name of the files, in any directory of a worktree, with patterns of paths that orto ignores.
+const IgnoreFileName = ".ortoignore"
+
+// PathRule is a pattern in gitignore syntax, and where it came from:
+//   - "*.log" (no separator) matches the name of a file or directory at any depth
+//   - "/build" or "docs/*.md" match from the directory of the file the pattern is in
+//   - "out/" only matches directories, and so everything under them
+//   - "**" matches any number of path elements, eg "docs/**/*.md"
+//   - "!keep.log" negates a pattern, so that a path matched by an earlier one is not, unless a directory above it is
+type PathRule struct {
+	Pattern  string   `json:"pattern"`
+	File     string   `json:"file,omitempty"` // Relative to the worktree, or absolute if outside. Empty for settings
+	Line     int      `json:"line,omitempty"`
+	dir      []string // The directory of File, whose paths the pattern is relative to
+	parts    []string
+	negated  bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ParsePathRule parses a line of a pattern file, or a pattern from the settings when file is empty. It returns false
+// for blank lines and comments.
+func ParsePathRule(line string, file string, lineNumber int) (PathRule, bool, error) {
+	rule := PathRule{File: file, Line: lineNumber}
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored, unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+	rule.Pattern = line
+	if negated, found := strings.CutPrefix(line, "!"); found {
+		rule.negated = true
+		line = negated
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if dir, found := strings.CutSuffix(line, "/"); found {
+		rule.dirOnly = true
+		line = dir
+	}
+	if anchored, found := strings.CutPrefix(line, "/"); found {
+		rule.anchored = true
+		line = anchored
+	}
+	rule.anchored = rule.anchored || strings.Contains(line, "/")
+	if line == "" {
+		return rule, false, errors.New("empty pattern '" + rule.Pattern + "'")
+	}
+	rule.parts = strings.Split(line, "/")
+	for _, part := range rule.parts {
+		if _, err := filepath.Match(part, ""); err != nil || part == "" || part == "." || part == ".." {
+			return rule, false, errors.New("invalid pattern '" + rule.Pattern + "'")
+		}
+	}
+	return rule, true, nil
+}
+
+// ValidPathRule is true for a pattern that ParsePathRule accepts.
+func ValidPathRule(pattern string) bool {
+	_, ok, err := ParsePathRule(pattern, "", 0)
+	return ok && err == nil
+}
+
+// ParsePathRules parses patterns from the settings.
+func ParsePathRules(patterns []string) []PathRule {
+	var rules []PathRule
+	for _, pattern := range patterns {
+		rule, ok, err := ParsePathRule(pattern, "", 0)
+		if err != nil || !ok {
+			log.Fatalf("Invalid path pattern '%s'", pattern)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ReadPathRules reads a pattern file, or returns nothing if there is none. file is how rules refer to it, and dir is
+// the directory that its patterns are relative to, as a clean path relative to the worktree.
+func ReadPathRules(absPath string, file string, dir string) []PathRule {
+	f, err := os.Open(absPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	var dirParts []string
+	if dir != "" {
+		dirParts = fp.FilepathParts(dir)
+	}
+	var rules []PathRule
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		rule, ok, err := ParsePathRule(scanner.Text(), file, lineNumber)
+		if err != nil {
+			log.Fatalf("%s:%d: %s", absPath, lineNumber, err)
+		}
+		if ok {
+			rule.dir = dirParts
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return rules
+}
+
+// String is the pattern and where it came from, eg "*.log (.ortoignore:3)".
+func (rule PathRule) String() string {
+	if rule.File == "" {
+		return rule.Pattern
+	}
+	return rule.Pattern + " (" + rule.File + ":" + strconv.Itoa(rule.Line) + ")"
+}
+
+// matches checks the path elements of a file or directory, relative to the worktree.
+func (rule *PathRule) matches(pathParts []string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if len(pathParts) <= len(rule.dir) {
+		return false
+	}
+	for i, part := range rule.dir {
+		if pathParts[i] != part {
+			return false
+		}
+	}
+	pathParts = pathParts[len(rule.dir):]
+	// A trailing "**" matches what is inside a directory, but not the directory
+	if rule.parts[len(rule.parts)-1] == "**" && len(pathParts) < len(rule.parts) {
+		return false
+	}
+	if !rule.anchored {
+		return matchPart(rule.parts[0], pathParts[len(pathParts)-1])
+	}
+	return matchParts(rule.parts, pathParts)
+}
+
+// PathMatcher matches the paths of a worktree against rules, which are those from the settings and then those in the
+// pattern file of each directory, if any, with later rules winning over earlier ones as in gitignore. Pattern files
+// are read when first needed, so a PathMatcher can be used from several goroutines.
+type PathMatcher struct {
+	absRoot  string
+	fileName string // The name of the pattern files, or empty for none
+	rules    []PathRule
+
+	mutex    sync.Mutex
+	dirRules map[string][]PathRule // By clean relative path, "" for the root
+}
+
+func NewPathMatcher(rules []PathRule, absRoot string, fileName string) *PathMatcher {
+	return &PathMatcher{absRoot: absRoot, fileName: fileName, rules: rules, dirRules: make(map[string][]PathRule)}
+}
+
+// IsEmpty is true if there are no rules, and no pattern files that could have some.
+func (matcher *PathMatcher) IsEmpty() bool {
+	return len(matcher.rules) == 0 && matcher.fileName == ""
+}
+
+// Match returns the rule that matches the file at cleanPath or one of the directories above it, or nil if none does
+// or the last that does is negated. As in gitignore, nothing under a matched directory can be negated.
+func (matcher *PathMatcher) Match(cleanPath string) *PathRule {
+	parts := fp.FilepathParts(cleanPath)
+	for i := 1; i <= len(parts); i++ {
+		rule := matcher.lastMatch(parts[:i], i < len(parts))
+		if rule != nil && !rule.negated {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (matcher *PathMatcher) lastMatch(parts []string, isDir bool) *PathRule {
+	var result *PathRule
+	check := func(rules []PathRule) {
+		for i := range rules {
+			if rules[i].matches(parts, isDir) {
+				result = &rules[i]
+			}
+		}
+	}
+	check(matcher.rules)
+	if matcher.fileName != "" {
+		// Deeper pattern files win over those above them
+		for i := range len(parts) {
+			check(matcher.rulesOfDir(filepath.Join(parts[:i]...)))
+		}
+	}
+	return result
+}
+
+func (matcher *PathMatcher) rulesOfDir(dir string) []PathRule {
+	matcher.mutex.Lock()
+	defer matcher.mutex.Unlock()
+	rules, found := matcher.dirRules[dir]
+	if !found {
+		relFile := filepath.Join(dir, matcher.fileName)
+		rules = ReadPathRules(filepath.Join(matcher.absRoot, relFile), relFile, dir)
+		matcher.dirRules[dir] = rules
+	}
+	return rules
+}
+
+func matchParts(patternParts []string, pathParts []string) bool {
+	if len(patternParts) == 0 {
+		return len(pathParts) == 0
+	}
+	if patternParts[0] == "**" {
+		for i := 0; i <= len(pathParts); i++ {
+			if matchParts(patternParts[1:], pathParts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(pathParts) == 0 || !matchPart(patternParts[0], pathParts[0]) {
+		return false
+	}
+	return matchParts(patternParts[1:], pathParts[1:])
+}
+
+func matchPart(pattern string, name string) bool {
+	matched, err := filepath.Match(pattern, name)
+	return err == nil && matched
+}
@@ -0,0 +1,63 @@
+package orto_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/orto"
+)
+
+func TestValidPathRule(t *testing.T) {
+	assert.True(t, orto.ValidPathRule("/build"))
+	assert.True(t, orto.ValidPathRule("!keep.log"))
+	assert.True(t, orto.ValidPathRule("out/"))
+	assert.False(t, orto.ValidPathRule(""))
+	assert.False(t, orto.ValidPathRule("# comment"))
+	assert.False(t, orto.ValidPathRule("/"))
+	assert.False(t, orto.ValidPathRule("a/../b"))
+	assert.False(t, orto.ValidPathRule("a/[b"))
+}
+
+func TestPathMatcher(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, orto.IgnoreFileName), "# Logs\n*.log\n!keep.log\n\nout/\n/build\n")
+	writeTestFile(t, filepath.Join(root, "sub", orto.IgnoreFileName), "!debug.log\ndocs/**/*.md\n")
+	matcher := orto.NewPathMatcher(orto.ParsePathRules([]string{"tmp", "cache/**"}), root, orto.IgnoreFileName)
+	test := func(path string, expected string) {
+		t.Helper()
+		rule := matcher.Match(filepath.FromSlash(path))
+		if expected == "" {
+			assert.True(t, rule == nil, path)
+		} else {
+			assert.True(t, rule != nil, path)
+			assert.Equal(t, expected, rule.String(), path)
+		}
+	}
+	test("a.txt", "")
+	test("a.log", "*.log (.ortoignore:2)")
+	test("x/y/a.log", "*.log (.ortoignore:2)")
+	test("keep.log", "")
+	test("out/a.txt", "out/ (.ortoignore:5)")
+	test("x/out/a.txt", "out/ (.ortoignore:5)")
+	test("out", "")
+	test("build/a.txt", "/build (.ortoignore:6)")
+	test("x/build/a.txt", "")
+	test("sub/debug.log", "")
+	test("sub/other.log", "*.log (.ortoignore:2)")
+	test("debug.log", "*.log (.ortoignore:2)")
+	test("sub/docs/a/b.md", "docs/**/*.md ("+filepath.Join("sub", orto.IgnoreFileName)+":2)")
+	test("docs/a/b.md", "")
+	test("tmp/a.txt", "tmp")
+	test("cache", "")
+	test("cache/a/b.txt", "cache/**")
+	// Nothing under an ignored directory can be negated
+	test("out/keep.log", "out/ (.ortoignore:5)")
+
+	includes := orto.NewPathMatcher(orto.ParsePathRules([]string{"*.go", "!*_test.go"}), root, "")
+	assert.False(t, includes.IsEmpty())
+	assert.True(t, includes.Match(filepath.FromSlash("src/a.go")) != nil)
+	assert.True(t, includes.Match(filepath.FromSlash("src/a_test.go")) == nil)
+	assert.True(t, includes.Match("README.md") == nil)
+	assert.True(t, orto.NewPathMatcher(nil, root, "").IsEmpty())
+}
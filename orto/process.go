@@ -1,17 +1,22 @@
 package orto
 
 import (
+	"fmt"
+	"iter"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	"github.com/anknetau/orto/fp"
 	"github.com/anknetau/orto/git"
 )
 
-type GitBlobAndFile struct {
-	FsFile  FSFile
-	GitBlob git.Blob
+// FilePair is a path that is in HEAD, in the worktree, or both.
+type FilePair struct {
+	GitBlob *git.Blob
+	FsFile  *FSFile
 }
 
 func Filter[T any, U any](items []T, callback func(*T) *U) []U {
@@ -33,6 +38,78 @@ func Index[T any](items []T, callback func(T) string) map[string]T {
 	return fsFileIndex
 }
 
+// ParallelMap calls callback for every item, on at most workers goroutines at a time, and returns the results in the
+// same order as the items.
+func ParallelMap[T any, U any](items []T, workers int, callback func(*T) U) []U {
+	result := make([]U, len(items))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(max(workers, 1), len(items)) {
+		wg.Go(func() {
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(items) {
+					return
+				}
+				result[i] = callback(&items[i])
+			}
+		})
+	}
+	wg.Wait()
+	return result
+}
+
+// ParallelMapSeq is ParallelMap for a sequence: it yields the results in the same order as the items, while reading
+// only a few items per worker ahead.
+func ParallelMapSeq[T any, U any](items iter.Seq[T], workers int, callback func(T) U) iter.Seq[U] {
+	return func(yield func(U) bool) {
+		workers = max(workers, 1)
+		type job struct {
+			item   T
+			result chan U
+		}
+		jobs := make(chan job)
+		pending := make(chan chan U, workers*2)
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for range workers {
+			wg.Go(func() {
+				for j := range jobs {
+					j.result <- callback(j.item)
+				}
+			})
+		}
+		go func() {
+			defer close(pending)
+			defer close(jobs)
+			for item := range items {
+				result := make(chan U, 1)
+				select {
+				case pending <- result:
+				case <-done:
+					return
+				}
+				select {
+				case jobs <- job{item, result}:
+				case <-done:
+					return
+				}
+			}
+		}()
+		defer func() {
+			close(done)
+			for range pending {
+			}
+			wg.Wait()
+		}()
+		for result := range pending {
+			if !yield(<-result) {
+				return
+			}
+		}
+	}
+}
+
 func copyContents(src *os.File, dest *os.File) int64 {
 	n, err := dest.ReadFrom(src)
 	if err != nil {
@@ -41,14 +118,15 @@ func copyContents(src *os.File, dest *os.File) int64 {
 	return n
 }
 
-func SaveGitBlob(gitEnv git.Env, checksum fp.Checksum, path string, destAbsoluteDirectory string) {
+func SaveGitBlob(gitEnv git.Env, checksum fp.Checksum, mode git.Mode, path string, destAbsoluteDirectory string) {
 	fp.CreateIntermediateDirectoriesForFile(path, destAbsoluteDirectory)
 
-	content := gitEnv.RunGetRawContent(checksum)
-	err := os.WriteFile(filepath.Join(destAbsoluteDirectory, path), content, 0644)
+	write, err := os.OpenFile(filepath.Join(destAbsoluteDirectory, path), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, storedPerm(mode))
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer write.Close()
+	gitEnv.RunStreamRawContent(checksum, write)
 }
 
 func CopyFile(sourceRelativePath string, destRelativePath string, destAbsoluteDirectory string) int64 {
@@ -67,6 +145,23 @@ func CopyFile(sourceRelativePath string, destRelativePath string, destAbsoluteDi
 	// TODO: we are assuming here that this is a file and not a directory.
 	fp.CreateIntermediateDirectoriesForFile(destRelativePath, destAbsoluteDirectory)
 
+	stat, err := os.Lstat(sourceRelativePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		// Store the target rather than what it points to, see storedPerm
+		target, err := os.Readlink(sourceRelativePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = os.WriteFile(destAbsoluteFile, []byte(target), storedPerm(git.ModeSymlink))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return int64(len(target))
+	}
+
 	read, err := os.Open(sourceRelativePath)
 	if err != nil {
 		log.Fatal(err)
@@ -81,98 +176,162 @@ func CopyFile(sourceRelativePath string, destRelativePath string, destAbsoluteDi
 	return copyContents(read, write)
 }
 
+// Verbosity is how much orto logs as it works, on stderr.
+type Verbosity int
+
+const (
+	VerbosityQuiet   Verbosity = iota // Only errors
+	VerbosityNormal                   // Progress and every file
+	VerbosityVerbose                  // Also what git reports, line by line
+)
+
+var verbosity = VerbosityNormal
+
+func SetVerbosity(v Verbosity) {
+	verbosity = v
+}
+
+func printLog(args ...any) {
+	if verbosity >= VerbosityNormal {
+		_, _ = fmt.Fprintln(os.Stderr, args...)
+	}
+}
+
 func PrintLogHeader(s string) {
-	println("✴️ " + s)
+	printLog("✴️ " + s)
 }
 
 func PrintLogCopy(src string, dst string) {
-	println("  🔹" + src + " → " + dst)
+	printLog("  🔹" + src + " → " + dst)
 }
 
 func PrintLogDel(src string) {
-	println("  🔹" + src + " ❌ ")
+	printLog("  🔹" + src + " ❌ ")
 }
 
 func PrintChange(change Change) {
 	switch change.Kind {
 	case ChangeKindAdded:
-		println("  ❇️ Added", change.FsFile.CleanPath)
+		printLog("  ❇️ Added", change.FsFile.CleanPath)
 	case ChangeKindDeleted:
-		println("  ❌ Deleted", change.GitBlob.CleanPath)
+		printLog("  ❌ Deleted", change.GitBlob.CleanPath)
 	case ChangeKindUnchanged:
-		println("  ➖ Unchanged", change.FsFile.CleanPath)
+		printLog("  ➖ Unchanged", change.FsFile.CleanPath)
 	case ChangeKindModified:
-		println("  ✏️ Modified", change.FsFile.CleanPath)
+		printLog("  ✏️ Modified", change.FsFile.CleanPath)
 	case ChangeKindIgnoredByGit:
-		println("  ⛔︎ GitIgnored", change.FsFile.CleanPath)
+		printLog("  ⛔︎ GitIgnored", change.FsFile.CleanPath)
 	case ChangeKindIgnoredByOrto:
-		println("  ⛔︎ OrtoIgnored", change.FsFile.CleanPath)
+		if change.IgnoredBy != nil {
+			printLog("  ⛔︎ OrtoIgnored", changePath(change), "by", change.IgnoredBy.String())
+		} else {
+			printLog("  ⛔︎ OrtoIgnored", changePath(change))
+		}
 	}
 }
 
-func CompareFiles(gitBlobs []git.Blob, fsFiles []FSFile, fsFileIndex map[string]FSFile, gitBlobIndex map[string]git.Blob) ([]GitBlobAndFile, []FSFile, []git.Blob) {
-	var common []GitBlobAndFile
-	var resultFsFiles []FSFile
-	var resultGitBlobs []git.Blob
-	for _, fsFile := range fsFiles {
-		gitBlob, ok := gitBlobIndex[fsFile.CleanPath]
-		if ok {
-			common = append(common, GitBlobAndFile{FsFile: fsFile, GitBlob: gitBlob})
-		} else {
-			resultFsFiles = append(resultFsFiles, fsFile)
-		}
+func PrintIndexChange(indexChange git.IndexChange) {
+	if indexChange.IsDeleted() {
+		printLog("  📥 Staged deletion", indexChange.Path)
+	} else {
+		printLog("  📥 Staged", indexChange.Path)
 	}
+}
+
+// MergeFiles joins blobs and files, both sorted in git's order, by path.
+func MergeFiles(gitBlobs iter.Seq[git.Blob], fsFiles iter.Seq[FSFile]) iter.Seq[FilePair] {
+	return func(yield func(FilePair) bool) {
+		nextGitBlob, stopGitBlobs := iter.Pull(gitBlobs)
+		defer stopGitBlobs()
+		nextFsFile, stopFsFiles := iter.Pull(fsFiles)
+		defer stopFsFiles()
 
-	for _, gitBlob := range gitBlobs {
-		_, ok := fsFileIndex[gitBlob.CleanPath]
-		if !ok {
-			resultGitBlobs = append(resultGitBlobs, gitBlob)
+		var lastPath string
+		checkOrder := func(path string) string {
+			path = filepath.ToSlash(path)
+			if path <= lastPath && lastPath != "" {
+				panic("Illegal state: " + path + " after " + lastPath)
+			}
+			return path
+		}
+		gitBlob, hasGitBlob := nextGitBlob()
+		fsFile, hasFsFile := nextFsFile()
+		for hasGitBlob || hasFsFile {
+			// Each pair gets its own copies, as they are handled concurrently
+			var pair FilePair
+			if hasGitBlob && (!hasFsFile || filepath.ToSlash(gitBlob.CleanPath) <= filepath.ToSlash(fsFile.CleanPath)) {
+				pairGitBlob := gitBlob
+				pair.GitBlob = &pairGitBlob
+			}
+			if hasFsFile && (!hasGitBlob || filepath.ToSlash(fsFile.CleanPath) <= filepath.ToSlash(gitBlob.CleanPath)) {
+				pairFsFile := fsFile
+				pair.FsFile = &pairFsFile
+			}
+			if pair.GitBlob != nil {
+				lastPath = checkOrder(pair.GitBlob.CleanPath)
+				gitBlob, hasGitBlob = nextGitBlob()
+			} else {
+				lastPath = checkOrder(pair.FsFile.CleanPath)
+			}
+			if pair.FsFile != nil {
+				fsFile, hasFsFile = nextFsFile()
+			}
+			if !yield(pair) {
+				return
+			}
 		}
 	}
-	return common, resultFsFiles, resultGitBlobs
 }
 
-func isOrtoIgnored(fsFile *FSFile, inputSettings InputSettings, gitEnv git.Env) bool {
-	if !inputSettings.copyDotGit && gitEnv.IsPartOfDotGit(fsFile.CleanPath) {
-		return true
+// isOrtoIgnored is true for the paths that orto leaves out, with the rule that ignores it unless it is part of .git or
+// is not included.
+func isOrtoIgnored(cleanPath string, inputSettings InputSettings, gitEnv git.Env) (bool, *PathRule) {
+	if !inputSettings.copyDotGit && gitEnv.IsPartOfDotGit(cleanPath) {
+		return true, nil
 	}
-	splitParts := fp.SplitFilePath(fsFile.CleanPath)
-	// TODO: this is just a little test:
-	if len(splitParts) > 0 && splitParts[0] == "third_party" || splitParts[0] == "laf" {
-		return true
+	if rule := inputSettings.ignores.Match(cleanPath); rule != nil {
+		return true, rule
 	}
-
-	//if len(parts) > 0 && parts[0] == ".venv" {
-	//	return true
-	//}
-	//if len(parts) > 0 && parts[0] == "out" {
-	//	return true
-	//}
-	//if len(parts) > 0 && parts[0] == "lib" {
-	//	return true
-	//}
-	//if len(parts) > 0 && parts[len(parts)-1] == ".DS_Store" {
-	//	return true
-	//}
-	return false
+	return !inputSettings.includes.IsEmpty() && inputSettings.includes.Match(cleanPath) == nil, nil
 }
 
-func ComparePair(gitBlob *git.Blob, fsFile *FSFile, gitIgnoredFilesIndex map[string]string, inputSettings InputSettings, gitEnv git.Env, hasher *git.Hasher) Change {
+func ComparePair(gitBlob *git.Blob, fsFile *FSFile, gitIgnoredFilesIndex map[string]string, inputSettings InputSettings, gitEnv git.Env, hasher *git.WorktreeHasher, statusPaths *git.StatusPaths) Change {
 	var fsFileChecksum fp.Checksum
+	var filtered bool
 	if fsFile != nil {
-		if isOrtoIgnored(fsFile, inputSettings, gitEnv) {
-			return Change{Kind: ChangeKindIgnoredByOrto, FsFile: fsFile}
+		if ignored, rule := isOrtoIgnored(fsFile.CleanPath, inputSettings, gitEnv); ignored {
+			return Change{Kind: ChangeKindIgnoredByOrto, FsFile: fsFile, IgnoredBy: rule}
 		}
 		if _, ignored := gitIgnoredFilesIndex[fsFile.CleanPath]; ignored {
-			return Change{Kind: ChangeKindIgnoredByGit, FsFile: fsFile}
+			// Only the files that are to be copied are hashed
+			if inputSettings.gitIgnored == nil {
+				return Change{Kind: ChangeKindIgnoredByGit, FsFile: fsFile}
+			}
+			if selected, _ := inputSettings.gitIgnored.selects(fsFile); !selected {
+				return Change{Kind: ChangeKindIgnoredByGit, FsFile: fsFile}
+			}
+			checksum, wasFiltered, err := hasher.Hash(fsFile.CleanPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return Change{Kind: ChangeKindIgnoredByGit, FsFile: fsFile, Checksum: checksum, Filtered: wasFiltered}
 		}
-		checksum, err := hasher.Hash(fsFile.Path)
-		if err != nil {
-			log.Fatal(err)
+		if checksum, known := knownWorktreeChecksum(gitBlob, fsFile, statusPaths, inputSettings.baseIsHead); known {
+			// git's checksum, so the content may have been filtered
+			mayFilter, err := hasher.MayFilter(fsFile.CleanPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fsFileChecksum = checksum
+			filtered = mayFilter
+		} else {
+			checksum, wasFiltered, err := hasher.Hash(fsFile.CleanPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fsFileChecksum = checksum
+			filtered = wasFiltered
 		}
-		//calculatedChecksum := fp.InternalChecksumBlob(fsFile.Path, gitEnv.Algo)
-		fsFileChecksum = fp.NewChecksum(checksum)
-		//fmt.Printf("'%s' checksum=%s calculatedChecksum=%s\n", fsFile.Path, checksum, calculatedChecksum)
 	}
 	if gitBlob == nil && fsFile == nil {
 		panic("Illegal state")
@@ -181,22 +340,48 @@ func ComparePair(gitBlob *git.Blob, fsFile *FSFile, gitIgnoredFilesIndex map[str
 		if gitBlob.CleanPath != fsFile.CleanPath {
 			panic("Illegal state: " + gitBlob.CleanPath + " " + fsFile.CleanPath)
 		}
-		// TODO: os.Stat follows symlinks apparently
-		stat, err := os.Stat(fsFile.Path)
+		stat, err := os.Lstat(fsFile.Path)
 		if err != nil {
 			log.Fatal(err)
 		}
 		if stat.IsDir() {
 			panic("was dir: " + fsFile.Path)
 		}
-		if fsFileChecksum == gitBlob.Checksum {
-			return Change{Kind: ChangeKindUnchanged, FsFile: fsFile, GitBlob: gitBlob}
+		if fsFileChecksum == gitBlob.Checksum && sameMode(git.ModeOfFileMode(stat.Mode()), gitBlob.Mode, inputSettings.fileModes) {
+			return Change{Kind: ChangeKindUnchanged, FsFile: fsFile, GitBlob: gitBlob, Checksum: fsFileChecksum, Filtered: filtered}
 		} else {
-			return Change{Kind: ChangeKindModified, FsFile: fsFile, GitBlob: gitBlob}
+			return Change{Kind: ChangeKindModified, FsFile: fsFile, GitBlob: gitBlob, Checksum: fsFileChecksum, Filtered: filtered}
 		}
 	} else if gitBlob != nil {
+		if ignored, rule := isOrtoIgnored(gitBlob.CleanPath, inputSettings, gitEnv); ignored {
+			return Change{Kind: ChangeKindIgnoredByOrto, GitBlob: gitBlob, IgnoredBy: rule}
+		}
 		return Change{Kind: ChangeKindDeleted, GitBlob: gitBlob}
 	} else {
-		return Change{Kind: ChangeKindAdded, FsFile: fsFile}
+		return Change{Kind: ChangeKindAdded, FsFile: fsFile, Checksum: fsFileChecksum, Filtered: filtered}
+	}
+}
+
+// sameMode is true if a worktree file has the mode that git has for it. Without fileModes, ie core.fileMode is false,
+// git doesn't trust the executable bit, so only a change to or from a symlink counts.
+func sameMode(fsMode git.Mode, gitMode git.Mode, fileModes bool) bool {
+	if fileModes {
+		return fsMode == gitMode
+	}
+	return (fsMode == git.ModeSymlink) == (gitMode == git.ModeSymlink)
+}
+
+// knownWorktreeChecksum returns the checksum of a worktree file when git already knows it from the index, so that it
+// need not be hashed: a tracked file that git status doesn't list is the same as in HEAD, and a listed one whose
+// worktree version matches the index has the staged checksum. Without statusPaths, nothing is known. git status
+// compares with HEAD, so when the blobs come from another base, only the staged checksums are of any use.
+func knownWorktreeChecksum(gitBlob *git.Blob, fsFile *FSFile, statusPaths *git.StatusPaths, baseIsHead bool) (fp.Checksum, bool) {
+	if statusPaths == nil {
+		return "", false
+	}
+	if gitBlob != nil && baseIsHead && !statusPaths.Listed[fsFile.CleanPath] {
+		return gitBlob.Checksum, true
 	}
+	checksum, found := statusPaths.MatchingIndex[fsFile.CleanPath]
+	return checksum, found
 }
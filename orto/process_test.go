@@ -0,0 +1,83 @@
+package orto_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/git"
+	"github.com/anknetau/orto/orto"
+)
+
+func TestParallelMap(t *testing.T) {
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+	var running, maxRunning atomic.Int32
+	result := orto.ParallelMap(items, 4, func(item *int) int {
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		return *item * 2
+	})
+	for i := range items {
+		assert.Equal(t, i*2, result[i])
+	}
+	assert.True(t, maxRunning.Load() <= 4)
+	assert.Equal(t, 0, len(orto.ParallelMap([]int{}, 4, func(item *int) int { return *item })))
+}
+
+func TestParallelMapSeq(t *testing.T) {
+	var result []int
+	for item := range orto.ParallelMapSeq(slices.Values([]int{1, 2, 3, 4, 5, 6, 7, 8, 9}), 3, func(item int) int {
+		time.Sleep(time.Duration(10-item) * time.Millisecond)
+		return item * 2
+	}) {
+		result = append(result, item)
+		if item == 12 {
+			break
+		}
+	}
+	assert.Equal(t, []int{2, 4, 6, 8, 10, 12}, result)
+}
+
+func TestMergeFiles(t *testing.T) {
+	gitBlobs := []git.Blob{{CleanPath: "a.txt"}, {CleanPath: "a/b"}, {CleanPath: "c"}}
+	fsFiles := []orto.FSFile{{CleanPath: "a/b"}, {CleanPath: "a0"}, {CleanPath: "d"}}
+	var paths []string
+	for pair := range orto.MergeFiles(slices.Values(gitBlobs), slices.Values(fsFiles)) {
+		switch {
+		case pair.GitBlob != nil && pair.FsFile != nil:
+			paths = append(paths, "both "+pair.GitBlob.CleanPath)
+		case pair.GitBlob != nil:
+			paths = append(paths, "git "+pair.GitBlob.CleanPath)
+		default:
+			paths = append(paths, "fs "+pair.FsFile.CleanPath)
+		}
+	}
+	assert.Equal(t, []string{"git a.txt", "both a/b", "fs a0", "git c", "fs d"}, paths)
+}
+
+func TestFsWalk(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"a.txt", "a/b", "a-b/c", "a0", "b"} {
+		assert.Equal(t, nil, os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0o755))
+		assert.Equal(t, nil, os.WriteFile(filepath.Join(root, path), []byte(path), 0o644))
+	}
+	var paths []string
+	for fsFile := range orto.FsWalk(root, filepath.Join(root, "b")) {
+		paths = append(paths, filepath.ToSlash(fsFile.CleanPath))
+	}
+	assert.Equal(t, []string{"a-b/c", "a.txt", "a/b", "a0"}, paths)
+}
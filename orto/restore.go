@@ -0,0 +1,496 @@
+package orto
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+// RestoreParameters are parameters set by the user for the restore phase
+type RestoreParameters struct {
+	ChangeSet          string // Change set directory, or its .json file
+	Destination        string // Directory within the git working tree to restore onto
+	PathToGitBinary    string
+	RestoreDotGit      bool
+	IgnoreHeadMismatch bool
+	ThreeWayMerge      bool // Merge into files that changed since the change set was taken, rather than refusing
+	RestoreIndex       bool // Also stage what was staged when the change set was taken
+	Filter             ChangeFilter
+	DryRun             bool     // Only list what would be restored
+	IdentityFiles      []string // age private keys, to decrypt encrypted change sets
+	Passphrase         string   // To decrypt change sets that were encrypted with one
+}
+
+type RestoreSettings struct {
+	changeSet          ChangeSet
+	restoreDotGit      bool
+	ignoreHeadMismatch bool
+	threeWayMerge      bool
+	restoreIndex       bool
+	filter             ChangeFilter
+	dryRun             bool
+	gitEnv             git.Env
+}
+
+// Resolve fills in what is not set from the configuration files of the destination's worktree and of the user,
+// then the defaults.
+func (params *RestoreParameters) Resolve(absDestinationDir string) {
+	config := LoadConfig(Config{IdentityFiles: params.IdentityFiles}, absDestinationDir)
+	if params.PathToGitBinary == "" {
+		params.PathToGitBinary = *config.PathToGitBinary
+	}
+	params.IdentityFiles = config.IdentityFiles
+}
+
+func Restore(params RestoreParameters) {
+	settings := applyDefaultsAndCheckRestoreParameters(&params)
+	defer settings.gitEnv.Close()
+	defer settings.changeSet.Close()
+	manifest := settings.changeSet.Manifest
+	checkHead(settings, manifest.Source.BaseCommit())
+	changes := restoreDiff(settings, manifest)
+	var indexEntries []IndexEntry
+	if settings.restoreIndex {
+		indexEntries = restoreIndexDiff(settings, manifest)
+	}
+	if settings.dryRun {
+		PrintLogHeader("Dry run: nothing was restored")
+		return
+	}
+	restoreWrite(settings, manifest, changes)
+	if settings.restoreIndex {
+		restoreIndexWrite(settings, indexEntries)
+	}
+	PrintLogHeader("Finished")
+}
+
+func applyDefaultsAndCheckRestoreParameters(params *RestoreParameters) RestoreSettings {
+	params.Filter.Check()
+
+	changeSet := OpenChangeSet(params.ChangeSet)
+	PrintLogHeader("Change set is '" + changeSet.AbsDir + "'")
+
+	absDestinationDir := CheckSourceDirectory(params.Destination)
+	params.Resolve(absDestinationDir)
+	changeSet.UseIdentities(ReadIdentities(params.IdentityFiles, params.Passphrase))
+	gitEnv := git.Find(params.PathToGitBinary, absDestinationDir)
+	PrintLogHeader("Found git version " + gitEnv.Version + " with algo " + string(gitEnv.Algo))
+	PrintLogHeader("Restoring onto worktree '" + gitEnv.AbsRoot + "' with .git at '" + gitEnv.AbsGitDir + "'")
+
+	if !fp.AbsolutePathsAreUnrelated(gitEnv.AbsRoot, changeSet.AbsDir) {
+		log.Fatalf("Change set and destination are related: %s and %s", params.ChangeSet, params.Destination)
+	}
+	return RestoreSettings{
+		changeSet:          changeSet,
+		restoreDotGit:      params.RestoreDotGit,
+		ignoreHeadMismatch: params.IgnoreHeadMismatch,
+		threeWayMerge:      params.ThreeWayMerge,
+		restoreIndex:       params.RestoreIndex,
+		filter:             params.Filter,
+		dryRun:             params.DryRun,
+		gitEnv:             gitEnv,
+	}
+}
+
+// CheckChangeSet accepts either the change set directory or its .json file, and returns the absolute paths to both.
+func CheckChangeSet(path string) (string, string) {
+	if len(path) == 0 {
+		log.Fatalf("Change set '%s' is not valid", path)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	absChangeSetDir, isJson := strings.CutSuffix(absPath, ".json")
+	absChangeSetJsonFile := absChangeSetDir + ".json"
+	if !isJson {
+		absChangeSetJsonFile = absPath + ".json"
+	}
+	fp.IsAbsPathToDirOrDie(absChangeSetDir, "Change set")
+	// TODO: os.Stat follows symlinks apparently
+	jsonStat, err := os.Stat(absChangeSetJsonFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonStat.IsDir() {
+		log.Fatalf("Change set file '%s' is a directory", absChangeSetJsonFile)
+	}
+	return absChangeSetDir, absChangeSetJsonFile
+}
+
+func checkHead(settings RestoreSettings, changeSetHead fp.Checksum) {
+	head := settings.gitEnv.RunGetHead()
+	if head == changeSetHead {
+		return
+	}
+	if !settings.ignoreHeadMismatch {
+		log.Fatalf("HEAD is at %s but the change set was taken against %s", head, changeSetHead)
+	}
+	PrintLogHeader("Ignoring HEAD mismatch: HEAD is at " + string(head) + " but the change set was taken against " + string(changeSetHead))
+}
+
+// restoreDiff works out what the change set would do to the destination. Only added, modified and deleted files, and
+// the files git ignores that were copied, are restored: unchanged files are already in HEAD.
+func restoreDiff(settings RestoreSettings, manifest Manifest) []Change {
+	PrintLogHeader("Reading change set...")
+	err := os.Chdir(settings.gitEnv.AbsRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var changes []Change
+	for _, entry := range manifest.Changes {
+		switch entry.Kind {
+		case ChangeKindAdded, ChangeKindModified, ChangeKindDeleted, ChangeKindIgnoredByGit:
+			if entry.Kind == ChangeKindIgnoredByGit && entry.Content == "" {
+				// Not copied
+				continue
+			}
+			change := entry.Change()
+			validateChange(change)
+			changes = append(changes, change)
+		}
+	}
+
+	if !settings.filter.IsEmpty() {
+		PrintLogHeader("Only restoring changes selected by the filter")
+	}
+	var result []Change
+	for _, c := range changes {
+		if !settings.restoreDotGit && isDotGitPath(changePath(c), settings.gitEnv) {
+			printLog("  ⛔︎ OrtoIgnored", changePath(c))
+			continue
+		}
+		if !settings.filter.Matches(c) {
+			continue
+		}
+		PrintChange(c)
+		result = append(result, c)
+	}
+	return result
+}
+
+type restoreAction int
+
+const (
+	restoreActionCopy restoreAction = iota
+	restoreActionMerge
+	restoreActionDelete
+	restoreActionNothing
+)
+
+func restoreWrite(settings RestoreSettings, manifest Manifest, changes []Change) {
+	PrintLogHeader("Restoring...")
+
+	hasher, err := settings.gitEnv.NewWorktreeHasher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func(hasher *git.WorktreeHasher) {
+		_ = hasher.Close()
+	}(hasher)
+
+	entries := Index(manifest.Changes, func(entry ManifestEntry) string {
+		return entry.Path
+	})
+
+	// Check everything before touching anything.
+	actions := make([]restoreAction, len(changes))
+	for i, change := range changes {
+		entry := entries[changePath(change)]
+		checkDecrypts(settings.changeSet, entry.Content, entry.Encrypted, "restore", entry.Path)
+		actions[i] = planRestore(change, entry, hasher, settings.threeWayMerge)
+		if actions[i] == restoreActionMerge {
+			checkDecrypts(settings.changeSet, entry.BaseContent, entry.Encrypted, "merge", entry.Path)
+		}
+	}
+
+	for i, change := range changes {
+		entry := entries[changePath(change)]
+		switch actions[i] {
+		case restoreActionCopy:
+			RestoreFile(settings.changeSet, entry.Content, entry.Encrypted, entry.Path, settings.gitEnv.AbsRoot, entry.Mode)
+			PrintLogCopy(settings.changeSet.Path(entry.Content), entry.Path)
+		case restoreActionMerge:
+			base, removeBase := mergeInput(settings.changeSet, entry.BaseContent, entry.Encrypted, settings.gitEnv.AbsGitDir)
+			other, removeOther := mergeInput(settings.changeSet, entry.Content, entry.Encrypted, settings.gitEnv.AbsGitDir)
+			content, conflicts, err := settings.gitEnv.RunMergeFile(entry.Path, base, other, "change set")
+			removeBase()
+			removeOther()
+			if err != nil {
+				log.Fatalf("Cannot merge %s: %s", entry.Path, err)
+			}
+			err = replaceFile(filepath.Join(settings.gitEnv.AbsRoot, entry.Path), restorePerm(entry.Mode), func(w io.Writer) error {
+				_, err := w.Write(content)
+				return err
+			})
+			if err != nil {
+				log.Fatalf("Cannot restore %s: %s", entry.Path, err)
+			}
+			if conflicts > 0 {
+				printLog("  ⚠️ " + entry.Path + " merged with " + strconv.Itoa(conflicts) + " conflicts")
+			} else {
+				printLog("  🔹" + entry.Path + " merged")
+			}
+		case restoreActionDelete:
+			err := os.Remove(entry.Path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			PrintLogDel(entry.Path)
+		case restoreActionNothing:
+		}
+	}
+}
+
+func restoreIndexDiff(settings RestoreSettings, manifest Manifest) []IndexEntry {
+	var result []IndexEntry
+	for _, entry := range manifest.Index {
+		if !settings.restoreDotGit && isDotGitPath(entry.Path, settings.gitEnv) {
+			continue
+		}
+		if !settings.filter.MatchesPath(entry.Path) {
+			continue
+		}
+		if !entry.IsDeleted() {
+			checkDecrypts(settings.changeSet, entry.Content, entry.Encrypted, "stage", entry.Path)
+		}
+		PrintIndexChange(git.IndexChange{Path: entry.Path, Mode: entry.Mode})
+		result = append(result, entry)
+	}
+	return result
+}
+
+// restoreIndexWrite stages exactly what was staged, by writing the saved blobs into the destination's object database
+// and pointing the index at them. The worktree is not touched.
+func restoreIndexWrite(settings RestoreSettings, entries []IndexEntry) {
+	PrintLogHeader("Restoring index...")
+	for _, entry := range entries {
+		if entry.IsDeleted() {
+			settings.gitEnv.RunRemoveFromIndex(entry.Path)
+			printLog("  📥 Removed from index " + entry.Path)
+			continue
+		}
+		read, err := settings.changeSet.Open(entry.Content, entry.Encrypted)
+		if err != nil {
+			log.Fatalf("Cannot stage %s: %s", entry.Path, err)
+		}
+		checksum := settings.gitEnv.RunWriteBlob(read)
+		_ = read.Close()
+		if checksum != entry.Checksum {
+			log.Fatalf("Staged content for %s does not match: expected %s but got %s", entry.Path, entry.Checksum, checksum)
+		}
+		settings.gitEnv.RunUpdateIndex(entry.Mode, checksum, entry.Path)
+		printLog("  📥 Staged " + entry.Path)
+	}
+}
+
+// planRestore decides how to restore a change, refusing to overwrite local changes unless they can be merged.
+func planRestore(change Change, entry ManifestEntry, hasher *git.WorktreeHasher, threeWayMerge bool) restoreAction {
+	path := changePath(change)
+	current, exists := hashIfExists(path, hasher)
+	switch change.Kind {
+	case ChangeKindAdded, ChangeKindIgnoredByGit:
+		if exists && current != change.Checksum {
+			log.Fatalf("Cannot restore %s: it already exists with different content", path)
+		}
+		return restoreActionCopy
+	case ChangeKindModified:
+		if !exists || current == change.Checksum || current == change.GitBlob.Checksum {
+			return restoreActionCopy
+		}
+		if !threeWayMerge {
+			log.Fatalf("Cannot restore %s: it has changes that are not in the change set's base", path)
+		}
+		if entry.BaseContent == "" {
+			log.Fatalf("Cannot merge %s: the change set has no base content for it", path)
+		}
+		if entry.Mode == git.ModeSymlink || change.GitBlob.Mode == git.ModeSymlink {
+			log.Fatalf("Cannot merge %s: it is a symlink", path)
+		}
+		return restoreActionMerge
+	case ChangeKindDeleted:
+		if !exists {
+			return restoreActionNothing
+		}
+		if current != change.GitBlob.Checksum {
+			log.Fatalf("Cannot delete %s: it has local changes", path)
+		}
+		return restoreActionDelete
+	default:
+		panic("Illegal state")
+	}
+}
+
+func hashIfExists(path string, hasher *git.WorktreeHasher) (fp.Checksum, bool) {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "", false
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if stat.IsDir() {
+		log.Fatalf("Cannot restore %s: it is a directory", path)
+	}
+	checksum, _, err := hasher.Hash(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return checksum, true
+}
+
+// checkDecrypts stops before anything is touched if a file of the change set is encrypted and cannot be decrypted.
+// Only the header of the file is read, which is enough to know that an identity fits.
+func checkDecrypts(changeSet ChangeSet, content string, encrypted bool, action string, path string) {
+	if content == "" || !encrypted {
+		return
+	}
+	read, err := changeSet.Open(content, encrypted)
+	if err != nil {
+		log.Fatalf("Cannot %s %s: %s", action, path, err)
+	}
+	_ = read.Close()
+}
+
+// mergeInput returns a file with the content of a file of the change set, for git merge-file, which only takes files.
+// An encrypted file is decrypted into the destination's git directory rather than a shared temporary directory, and
+// only readable by the user. The returned function removes it.
+func mergeInput(changeSet ChangeSet, content string, encrypted bool, absGitDir string) (string, func()) {
+	if !encrypted {
+		return changeSet.Path(content), func() {}
+	}
+	read, err := changeSet.Open(content, encrypted)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer read.Close()
+	// CreateTemp makes the file with 0600
+	write, err := os.CreateTemp(absGitDir, "orto-merge-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	remove := func() {
+		_ = write.Close()
+		_ = os.Remove(write.Name())
+	}
+	if _, err = io.Copy(write, read); err != nil {
+		remove()
+		log.Fatalf("Cannot decrypt %s: %s", content, err)
+	}
+	if err = write.Close(); err != nil {
+		remove()
+		log.Fatal(err)
+	}
+	return write.Name(), remove
+}
+
+// RestoreFile copies a file from the change set into the worktree, replacing whatever was there. An encrypted file is
+// decrypted as it is copied.
+func RestoreFile(changeSet ChangeSet, content string, encrypted bool, relPath string, absRoot string, mode git.Mode) int64 {
+	if !filepath.IsLocal(relPath) {
+		panic("Non-local path " + relPath)
+	}
+	fp.CreateIntermediateDirectoriesForFile(relPath, absRoot)
+	// A symlink in the change set, or a file holding the target, is read as the target
+	read, err := changeSet.Open(content, encrypted)
+	if err != nil {
+		log.Fatalf("Cannot restore %s: %s", relPath, err)
+	}
+	defer read.Close()
+	if mode == git.ModeSymlink {
+		return restoreSymlink(read, filepath.Join(absRoot, relPath))
+	}
+
+	var n int64
+	err = replaceFile(filepath.Join(absRoot, relPath), restorePerm(mode), func(w io.Writer) error {
+		n, err = io.Copy(w, read)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Cannot restore %s: %s", relPath, err)
+	}
+	return n
+}
+
+// restorePerm is the permissions of a restored file, given its mode in git.
+func restorePerm(mode git.Mode) os.FileMode {
+	if mode == git.ModeExecutable {
+		return 0755
+	}
+	return 0644
+}
+
+// replaceFile writes a file next to absPath, and then renames it over whatever was there, so that a symlink that
+// already exists at absPath is replaced rather than written through.
+func replaceFile(absPath string, perm os.FileMode, write func(io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(absPath), ".orto-restore-")
+	if err != nil {
+		return err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	// CreateTemp makes the file with 0600, and Chmod is not affected by the umask
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(f)
+	if err = write(buffered); err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), absPath); err != nil {
+		return err
+	}
+	renamed = true
+	return nil
+}
+
+// restoreSymlink recreates a symlink, whose target is read from the change set.
+func restoreSymlink(read io.Reader, absDest string) int64 {
+	target, err := io.ReadAll(read)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Remove(absDest)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	err = os.Symlink(string(target), absDest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return int64(len(target))
+}
+
+// isDotGitPath is true for anything inside the repository's .git, including a .git gitfile in a linked worktree.
+func isDotGitPath(cleanPath string, gitEnv git.Env) bool {
+	parts := fp.FilepathParts(cleanPath)
+	if len(parts) > 0 && parts[0] == ".git" {
+		return true
+	}
+	return gitEnv.IsPartOfDotGit(cleanPath)
+}
+
+func changePath(change Change) string {
+	if change.FsFile != nil {
+		return change.FsFile.CleanPath
+	}
+	return change.GitBlob.CleanPath
+}
@@ -0,0 +1,150 @@
+package orto_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/orto"
+)
+
+// fatalTestVariable names the call to expectFatal that a child process of the test runs.
+const fatalTestVariable = "ORTO_TEST_FATAL"
+
+// expectFatal checks that run stops with log.Fatal, logging message. As that exits, the test is run again in a child
+// process, which goes as far as the call to expectFatal with the same name, and runs run there.
+func expectFatal(t *testing.T, name string, message string, run func()) {
+	t.Helper()
+	if child := os.Getenv(fatalTestVariable); child != "" {
+		if child == name {
+			run()
+			os.Exit(0)
+		}
+		return
+	}
+	executable, err := os.Executable()
+	assert.Equal(t, nil, err)
+	cmd := exec.Command(executable, "-test.run=^"+t.Name()+"$")
+	cmd.Env = append(os.Environ(), fatalTestVariable+"="+name, "TMPDIR="+t.TempDir())
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	assert.True(t, errors.As(err, &exitErr), name+": "+string(out))
+	assert.True(t, strings.Contains(string(out), message), name+": "+string(out))
+}
+
+// saveTestChangeSet clones source, so that the change set can be restored onto a worktree at the same commit, and then
+// saves the changes in source as a change set.
+func saveTestChangeSet(t *testing.T, root string, source string) (string, string) {
+	t.Helper()
+	destination := filepath.Join(root, "destination")
+	runTestGit(t, root, "clone", "--quiet", source, destination)
+	changeSetFile := filepath.Join(root, "out.zip")
+	orto.Run(orto.UserParameters{Source: source, Destination: changeSetFile, ChangeSetName: "cs"})
+	return changeSetFile, destination
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	assert.Equal(t, nil, err)
+	return string(content)
+}
+
+func TestRestore(t *testing.T) {
+	root, source := newTestRepo(t, map[string]string{
+		"run.sh":      "echo base\n",
+		"notes.txt":   "../outside.txt",
+		"deleted.txt": "deleted\n",
+	})
+	writeTestFile(t, filepath.Join(source, "run.sh"), "echo worktree\n")
+	assert.Equal(t, nil, os.Chmod(filepath.Join(source, "run.sh"), 0755))
+	writeTestFile(t, filepath.Join(source, "notes.txt"), "worktree notes\n")
+	writeTestFile(t, filepath.Join(source, "added", "new.txt"), "added\n")
+	assert.Equal(t, nil, os.Remove(filepath.Join(source, "deleted.txt")))
+	changeSetFile, destination := saveTestChangeSet(t, root, source)
+
+	// A symlink whose target is the content in HEAD passes the checks, and must be replaced rather than written through
+	writeTestFile(t, filepath.Join(root, "outside.txt"), "outside\n")
+	assert.Equal(t, nil, os.Remove(filepath.Join(destination, "notes.txt")))
+	assert.Equal(t, nil, os.Symlink("../outside.txt", filepath.Join(destination, "notes.txt")))
+
+	orto.Restore(orto.RestoreParameters{ChangeSet: changeSetFile, Destination: destination})
+	for _, path := range []string{"run.sh", "notes.txt", filepath.Join("added", "new.txt")} {
+		assert.Equal(t, readTestFile(t, filepath.Join(source, path)), readTestFile(t, filepath.Join(destination, path)), path)
+	}
+	assert.Equal(t, "outside\n", readTestFile(t, filepath.Join(root, "outside.txt")))
+	stat, err := os.Lstat(filepath.Join(destination, "notes.txt"))
+	assert.Equal(t, nil, err)
+	assert.True(t, stat.Mode().IsRegular())
+	stat, err = os.Stat(filepath.Join(destination, "run.sh"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+	_, err = os.Stat(filepath.Join(destination, "deleted.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestRestoreRefusesLocalChanges checks that files with changes that are not in the change set stop the restore
+// before any file is touched.
+func TestRestoreRefusesLocalChanges(t *testing.T) {
+	root, source := newTestRepo(t, map[string]string{
+		"modified.txt": "base\n",
+		"deleted.txt":  "base\n",
+	})
+	writeTestFile(t, filepath.Join(source, "modified.txt"), "worktree\n")
+	writeTestFile(t, filepath.Join(source, "added.txt"), "added\n")
+	assert.Equal(t, nil, os.Remove(filepath.Join(source, "deleted.txt")))
+	changeSetFile, destination := saveTestChangeSet(t, root, source)
+	restore := func() {
+		orto.Restore(orto.RestoreParameters{ChangeSet: changeSetFile, Destination: destination})
+	}
+
+	writeTestFile(t, filepath.Join(destination, "modified.txt"), "local\n")
+	expectFatal(t, "modified", "Cannot restore modified.txt: it has changes that are not in the change set's base", restore)
+	assert.Equal(t, "local\n", readTestFile(t, filepath.Join(destination, "modified.txt")))
+	_, err := os.Stat(filepath.Join(destination, "added.txt"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "base\n", readTestFile(t, filepath.Join(destination, "deleted.txt")))
+	runTestGit(t, destination, "checkout", "--quiet", "modified.txt")
+
+	writeTestFile(t, filepath.Join(destination, "added.txt"), "local\n")
+	expectFatal(t, "added", "Cannot restore added.txt: it already exists with different content", restore)
+	assert.Equal(t, "base\n", readTestFile(t, filepath.Join(destination, "modified.txt")))
+	assert.Equal(t, nil, os.Remove(filepath.Join(destination, "added.txt")))
+
+	writeTestFile(t, filepath.Join(destination, "deleted.txt"), "local\n")
+	expectFatal(t, "deleted", "Cannot delete deleted.txt: it has local changes", restore)
+	assert.Equal(t, "base\n", readTestFile(t, filepath.Join(destination, "modified.txt")))
+	_, err = os.Stat(filepath.Join(destination, "added.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreThreeWayMerge(t *testing.T) {
+	root, source := newTestRepo(t, map[string]string{
+		"merged.sh":    "one\ntwo\nthree\nfour\nfive\n",
+		"conflict.txt": "base\n",
+	})
+	writeTestFile(t, filepath.Join(source, "merged.sh"), "one\nTWO\nthree\nfour\nfive\n")
+	assert.Equal(t, nil, os.Chmod(filepath.Join(source, "merged.sh"), 0755))
+	writeTestFile(t, filepath.Join(source, "conflict.txt"), "worktree\n")
+	changeSetFile, destination := saveTestChangeSet(t, root, source)
+	writeTestFile(t, filepath.Join(destination, "merged.sh"), "one\ntwo\nthree\nfour\nFIVE\n")
+	writeTestFile(t, filepath.Join(destination, "conflict.txt"), "local\n")
+
+	orto.Restore(orto.RestoreParameters{ChangeSet: changeSetFile, Destination: destination, ThreeWayMerge: true})
+	assert.Equal(t, "one\nTWO\nthree\nfour\nFIVE\n", readTestFile(t, filepath.Join(destination, "merged.sh")))
+	stat, err := os.Stat(filepath.Join(destination, "merged.sh"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+	conflict := readTestFile(t, filepath.Join(destination, "conflict.txt"))
+	assert.True(t, strings.Contains(conflict, "<<<<<<< current\nlocal\n"), conflict)
+	assert.True(t, strings.Contains(conflict, "=======\nworktree\n>>>>>>> change set\n"), conflict)
+	entries, err := os.ReadDir(destination)
+	assert.Equal(t, nil, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), ".orto-"), entry.Name())
+	}
+}
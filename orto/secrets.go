@@ -0,0 +1,217 @@
+package orto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/anknetau/orto/git"
+)
+
+// SecretAction is what happens to a saved file that looks like it holds a secret, eg a private key.
+type SecretAction string
+
+const (
+	SecretsOff     SecretAction = "off"
+	SecretsReport  SecretAction = "report"  // Warn, and record what was found in the manifest
+	SecretsRefuse  SecretAction = "refuse"  // Stop before the file is written
+	SecretsEncrypt SecretAction = "encrypt" // Encrypt the file, whatever the encryption scope
+)
+
+func (action SecretAction) IsValid() bool {
+	return action == SecretsOff || action == SecretsReport || action == SecretsRefuse || action == SecretsEncrypt
+}
+
+// strictness orders the actions by how little of a secret they let out. Refusing is the strictest, as nothing is saved.
+func (action SecretAction) strictness() int {
+	return slices.Index([]SecretAction{SecretsOff, SecretsReport, SecretsEncrypt, SecretsRefuse}, action)
+}
+
+// SecretRule finds secrets in the lines of a file.
+type SecretRule struct {
+	Name       string  `toml:"name"`
+	Pattern    string  `toml:"pattern"`     // A regular expression. If it has groups, the first is the secret
+	MinEntropy float64 `toml:"min_entropy"` // Of the secret, in bits per character, to tell keys from placeholders
+}
+
+// BuiltinSecretRules are always used, before those that are configured.
+var BuiltinSecretRules = []SecretRule{
+	{Name: "private-key", Pattern: `-----BEGIN[ A-Z0-9]*PRIVATE KEY( BLOCK)?-----`},
+	{Name: "aws-access-key-id", Pattern: `\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`, MinEntropy: 3},
+	{Name: "aws-secret-access-key", Pattern: `(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`, MinEntropy: 4},
+	{Name: "github-token", Pattern: `\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`, MinEntropy: 3},
+	{Name: "npm-token", Pattern: `\b(npm_[A-Za-z0-9]{36})\b`, MinEntropy: 3},
+	{Name: "npmrc-auth", Pattern: `_auth(?:Token)?\s*=\s*["']?([^\s"'$]{16,})`, MinEntropy: 3},
+	{Name: "slack-token", Pattern: `\b(xox[abprs]-[0-9A-Za-z-]{10,})\b`, MinEntropy: 3},
+	{Name: "stripe-key", Pattern: `\b([rs]k_live_[0-9A-Za-z]{24,})\b`, MinEntropy: 3},
+	{Name: "google-api-key", Pattern: `\b(AIza[0-9A-Za-z_-]{35})\b`, MinEntropy: 3},
+	{Name: "generic-secret", Pattern: `(?i)(?:password|passwd|secret|token|api[_-]?key|access[_-]?key)[\w.-]*["']?\s*[:=]\s*["']?([^\s"',;]{12,})`, MinEntropy: 3.5},
+}
+
+func (rule SecretRule) compile() (*regexp.Regexp, error) {
+	if rule.Name == "" {
+		return nil, errors.New("a secret rule needs a name")
+	}
+	if rule.MinEntropy < 0 {
+		return nil, errors.New("negative min_entropy in secret rule " + rule.Name)
+	}
+	return regexp.Compile(rule.Pattern)
+}
+
+// SecretFinding is a line of a file that a rule matched. The secret itself is never recorded.
+type SecretFinding struct {
+	Rule string `json:"rule"`
+	Line int    `json:"line"`
+}
+
+func (finding SecretFinding) String() string {
+	return finding.Rule + " on line " + strconv.Itoa(finding.Line)
+}
+
+// secretOverlap is how much of a long line is scanned twice, at the end of a piece and at the start of the next. It
+// is longer than any secret the rules are meant to find.
+const secretOverlap = 4 * 1024
+
+// SecretScanner looks for secrets with the built-in rules and some more.
+type SecretScanner struct {
+	rules   []SecretRule
+	regexps []*regexp.Regexp
+}
+
+func NewSecretScanner(rules []SecretRule) *SecretScanner {
+	scanner := &SecretScanner{rules: slices.Concat(BuiltinSecretRules, rules)}
+	for _, rule := range scanner.rules {
+		re, err := rule.compile()
+		if err != nil {
+			log.Fatalf("Invalid secret rule %s: %s", rule.Name, err)
+		}
+		scanner.regexps = append(scanner.regexps, re)
+	}
+	return scanner
+}
+
+// Scan returns what the rules match, at most once per rule and line. Binary content, ie with a NUL byte near the
+// start as git decides, is not scanned.
+func (scanner *SecretScanner) Scan(r io.Reader) ([]SecretFinding, error) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	if head, _ := reader.Peek(8000); bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+	var findings []SecretFinding
+	var overlap []byte
+	for line := 1; ; {
+		// A line longer than the buffer is scanned in pieces, each starting with the end of the one before, so that a
+		// secret across two pieces is seen whole
+		chunk, err := reader.ReadSlice('\n')
+		if len(overlap) > 0 {
+			chunk = slices.Concat(overlap, chunk)
+			overlap = nil
+		}
+		for i, rule := range scanner.rules {
+			finding := SecretFinding{Rule: rule.Name, Line: line}
+			if scanner.matches(i, chunk) && !slices.Contains(findings, finding) {
+				findings = append(findings, finding)
+			}
+		}
+		if err == nil {
+			line++
+		} else if err == io.EOF {
+			return findings, nil
+		} else if errors.Is(err, bufio.ErrBufferFull) {
+			overlap = slices.Clone(chunk[max(0, len(chunk)-secretOverlap):])
+		} else {
+			return nil, err
+		}
+	}
+}
+
+// matches is true if rule i matches, with a secret that is random enough.
+func (scanner *SecretScanner) matches(i int, chunk []byte) bool {
+	for _, match := range scanner.regexps[i].FindAllSubmatch(chunk, -1) {
+		secret := match[0]
+		if len(match) > 1 && match[1] != nil {
+			secret = match[1]
+		}
+		if shannonEntropy(secret) >= scanner.rules[i].MinEntropy {
+			return true
+		}
+	}
+	return false
+}
+
+// shannonEntropy is in bits per byte, eg 0 for "aaaa" and 2 for "abcd".
+func shannonEntropy(s []byte) float64 {
+	var counts [256]int
+	for _, b := range s {
+		counts[b]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(s))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// findSecrets scans the worktree version of a file that is saved and is not in the base, ie an added, modified or
+// copied ignored file. The target of a symlink is not scanned.
+func findSecrets(change Change, scanner *SecretScanner) []SecretFinding {
+	if scanner == nil || change.Checksum == "" {
+		return nil
+	}
+	if change.Kind != ChangeKindAdded && change.Kind != ChangeKindModified && change.Kind != ChangeKindIgnoredByGit {
+		return nil
+	}
+	if change.FsFile.DirEntry != nil && change.FsFile.DirEntry.Type()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	f, err := os.Open(change.FsFile.Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	findings, err := scanner.Scan(f)
+	if err != nil {
+		log.Fatalf("Cannot scan %s for secrets: %s", change.FsFile.CleanPath, err)
+	}
+	return findings
+}
+
+// findStagedSecrets scans the staged versions of files, except for symlinks and submodules, and returns what it finds
+// by path.
+func findStagedSecrets(indexChanges []git.IndexChange, scanner *SecretScanner, gitEnv git.Env) map[string][]SecretFinding {
+	result := make(map[string][]SecretFinding)
+	if scanner == nil {
+		return result
+	}
+	for _, indexChange := range indexChanges {
+		if indexChange.Mode != git.ModeFile && indexChange.Mode != git.ModeExecutable {
+			continue
+		}
+		reader, writer := io.Pipe()
+		go func() {
+			gitEnv.RunStreamRawContent(indexChange.Checksum, writer)
+			_ = writer.Close()
+		}()
+		findings, err := scanner.Scan(reader)
+		// Whatever was not scanned, so that git is not left waiting
+		_, _ = io.Copy(io.Discard, reader)
+		if err != nil {
+			log.Fatalf("Cannot scan the staged %s for secrets: %s", indexChange.Path, err)
+		}
+		if len(findings) > 0 {
+			result[indexChange.Path] = findings
+		}
+	}
+	return result
+}
@@ -0,0 +1,202 @@
+package orto
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// tarWriter writes a change set as a single tar archive, optionally compressed. Like zipWriter, its contents mirror the
+// directory output, except that symlinks are kept as symlinks. Contents are streamed into the archive, never held in
+// memory whole.
+type tarWriter struct {
+	ctx        OutputContext
+	file       *os.File
+	buffered   *bufio.Writer
+	compressor io.WriteCloser
+	tar        *tar.Writer
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newCompressor(format OutputFormat, w io.Writer) (io.WriteCloser, error) {
+	switch format {
+	case OutputFormatTar:
+		return nopWriteCloser{w}, nil
+	case OutputFormatTarGz:
+		return gzip.NewWriter(w), nil
+	case OutputFormatTarBz2:
+		return bzip2.NewWriter(w, nil)
+	case OutputFormatTarZstd:
+		return zstd.NewWriter(w)
+	case OutputFormatTarXz:
+		return xz.NewWriter(w)
+	}
+	panic("Not a tar format: " + string(format))
+}
+
+func (w *tarWriter) begin() error {
+	// O_EXCL as the destination was checked to not exist
+	f, err := os.OpenFile(w.ctx.DestinationFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.buffered = bufio.NewWriter(f)
+	w.compressor, err = newCompressor(w.ctx.Format, w.buffered)
+	if err != nil {
+		return err
+	}
+	w.tar = tar.NewWriter(w.compressor)
+	return nil
+}
+
+func (w *tarWriter) entryName(relPath string) string {
+	return path.Join(w.ctx.ChangeSetName, filepath.ToSlash(relPath))
+}
+
+func (w *tarWriter) putFile(relPath string, fsFile *FSFile, _ fp.Checksum, _ bool) error {
+	info, err := fsFile.DirEntry.Info()
+	if err != nil {
+		return err
+	}
+	var read *os.File
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(fsFile.Path)
+		if err != nil {
+			return err
+		}
+	} else {
+		read, err = os.Open(fsFile.Path)
+		if err != nil {
+			return err
+		}
+		defer read.Close()
+		// The header has the size, so it is taken from the file that is copied rather than from the walk
+		if info, err = read.Stat(); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = w.entryName(relPath)
+	header.Mode = int64(git.ModeOfFileMode(info.Mode()).FileMode().Perm())
+	// Owners are meaningless outside this machine
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if err = w.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	return copySized(w.tar, read, header.Size)
+}
+
+// copySized copies a file whose size is already in the archive, and fails if the file grew or shrank since.
+func copySized(w io.Writer, f *os.File, size int64) error {
+	n, err := io.CopyN(w, f, size)
+	if err == io.EOF {
+		return fmt.Errorf("%s shrank from %d to %d bytes while being saved", f.Name(), size, n)
+	} else if err != nil {
+		return err
+	}
+	if extra, _ := f.Read(make([]byte, 1)); extra > 0 {
+		return fmt.Errorf("%s grew from %d bytes while being saved", f.Name(), size)
+	}
+	return nil
+}
+
+func (w *tarWriter) putBlob(relPath string, checksum fp.Checksum, mode git.Mode) error {
+	header := &tar.Header{
+		Name:    w.entryName(relPath),
+		Mode:    int64(mode.FileMode().Perm()),
+		ModTime: w.ctx.StartTime,
+		Format:  tar.FormatPAX,
+	}
+	if mode == git.ModeSymlink {
+		// The content of a symlink blob is its target, which is small
+		var target bytes.Buffer
+		w.ctx.GitEnv.RunStreamRawContent(checksum, &target)
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = target.String()
+		return w.tar.WriteHeader(header)
+	}
+	header.Typeflag = tar.TypeReg
+	header.Size = w.ctx.GitEnv.RunGetObjectSize(checksum)
+	if err := w.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	w.ctx.GitEnv.RunStreamRawContent(checksum, w.tar)
+	return nil
+}
+
+func (w *tarWriter) putStream(relPath string, write func(io.Writer) error) error {
+	// The header has the size, so the content is spooled first
+	return spool(write, func(f *os.File, size int64) error {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     w.entryName(relPath),
+			Mode:     0600,
+			Size:     size,
+			ModTime:  w.ctx.StartTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := w.tar.WriteHeader(header); err != nil {
+			return err
+		}
+		return copySized(w.tar, f, size)
+	})
+}
+
+func (w *tarWriter) finish(manifest Manifest) error {
+	var content bytes.Buffer
+	if err := EncodeManifest(&content, manifest); err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     w.ctx.ChangeSetName + ".json",
+		Mode:     0644,
+		Size:     int64(content.Len()),
+		ModTime:  w.ctx.StartTime,
+		Format:   tar.FormatPAX,
+	}
+	if err := w.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := w.tar.Write(content.Bytes()); err != nil {
+		return err
+	}
+	for _, closer := range []io.Closer{w.tar, w.compressor} {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	if err := w.buffered.Flush(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *tarWriter) location(relPath string) string {
+	return w.ctx.DestinationFile + ":" + w.entryName(relPath)
+}
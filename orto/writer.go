@@ -0,0 +1,257 @@
+package orto
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+// changeSetWriter stores the files of a change set somewhere, following the layout described in LayoutWorktreeDir.
+// Paths are relative to the change set, eg "worktree/src/main.go". layoutWriter turns one into an OutputWriter.
+type changeSetWriter interface {
+	begin() error
+	// putFile stores a file from the worktree, whose object id is checksum, possibly after git's filters. The working
+	// directory is the root of the worktree.
+	putFile(path string, fsFile *FSFile, checksum fp.Checksum, filtered bool) error
+	// putBlob stores a blob from the git repository.
+	putBlob(path string, checksum fp.Checksum, mode git.Mode) error
+	// putStream stores content that is neither in the worktree nor in git, eg an encrypted file, as write writes it.
+	putStream(path string, write func(io.Writer) error) error
+	finish(manifest Manifest) error
+	// location describes where the given path ends up, for logging.
+	location(path string) string
+}
+
+func init() {
+	layout := func(newWriter func(ctx OutputContext) changeSetWriter) OutputWriterFactory {
+		return func(ctx OutputContext) OutputWriter {
+			return &layoutWriter{writer: newWriter(ctx), ctx: ctx}
+		}
+	}
+	RegisterOutputFormat(OutputFormatDirectory, OutputTargetDirectory, layout(func(ctx OutputContext) changeSetWriter {
+		return &dirWriter{ctx: ctx}
+	}))
+	RegisterOutputFormat(OutputFormatZip, OutputTargetFile, layout(func(ctx OutputContext) changeSetWriter {
+		return &zipWriter{ctx: ctx}
+	}))
+	for _, format := range []OutputFormat{OutputFormatTar, OutputFormatTarGz, OutputFormatTarBz2, OutputFormatTarZstd, OutputFormatTarXz} {
+		RegisterOutputFormat(format, OutputTargetFile, layout(func(ctx OutputContext) changeSetWriter {
+			return &tarWriter{ctx: ctx}
+		}))
+	}
+	RegisterOutputFormat(OutputFormatGitRepo, OutputTargetRepository, layout(func(ctx OutputContext) changeSetWriter {
+		return &gitRepoWriter{ctx: ctx}
+	}))
+	RegisterOutputFormat(OutputFormatBundle, OutputTargetFile, layout(func(ctx OutputContext) changeSetWriter {
+		return &bundleWriter{ctx: ctx}
+	}))
+	RegisterOutputFormat(OutputFormatPatch, OutputTargetFile, func(ctx OutputContext) OutputWriter {
+		return &patchWriter{ctx: ctx}
+	})
+}
+
+// layoutWriter is the OutputWriter for formats that hold a copy of every file: worktree files go under
+// LayoutWorktreeDir, HEAD versions under LayoutBaseDir and staged versions under LayoutIndexDir. Encrypted files have
+// EncryptedSuffix added to their path.
+type layoutWriter struct {
+	writer changeSetWriter
+	ctx    OutputContext
+}
+
+func (w *layoutWriter) Begin() error {
+	return w.writer.begin()
+}
+
+func (w *layoutWriter) PutWorktreeFile(change Change, entry *ManifestEntry) error {
+	path := filepath.Join(LayoutWorktreeDir, change.FsFile.CleanPath)
+	// Already set when another version of the path is encrypted
+	if entry.Encrypted || w.ctx.Encryption.encryptsFile(change) {
+		var err error
+		path, err = w.putEncrypted(path, func(dst io.Writer) error {
+			return copyWorktreeContent(change.FsFile, dst)
+		})
+		if err != nil {
+			return err
+		}
+		entry.Encrypted = true
+	} else if err := w.writer.putFile(path, change.FsFile, change.Checksum, change.Filtered); err != nil {
+		return err
+	}
+	entry.Content = path
+	return nil
+}
+
+func (w *layoutWriter) PutBaseBlob(change Change, entry *ManifestEntry) error {
+	// The worktree version of a modified file is put first, and if it was encrypted, so is this, as the manifest has
+	// a single flag for both
+	encrypt := entry.Encrypted || w.ctx.Encryption.encryptsBlobs()
+	path, err := w.putBlob(filepath.Join(LayoutBaseDir, change.GitBlob.CleanPath), change.GitBlob.Checksum, change.GitBlob.Mode, encrypt)
+	if err != nil {
+		return err
+	}
+	entry.BaseContent = path
+	entry.Encrypted = encrypt
+	return nil
+}
+
+func (w *layoutWriter) RecordDeletion(Change, *ManifestEntry) error {
+	// The manifest is enough
+	return nil
+}
+
+func (w *layoutWriter) PutIndexBlob(indexChange git.IndexChange, entry *IndexEntry) error {
+	// Already set when the worktree version of the path is encrypted, or another version holds a secret
+	encrypt := entry.Encrypted || w.ctx.Encryption.encryptsBlobs()
+	path, err := w.putBlob(filepath.Join(LayoutIndexDir, indexChange.Path), indexChange.Checksum, indexChange.Mode, encrypt)
+	if err != nil {
+		return err
+	}
+	entry.Content = path
+	entry.Encrypted = encrypt
+	return nil
+}
+
+// putBlob stores a blob, encrypted or not, and returns where it went.
+func (w *layoutWriter) putBlob(path string, checksum fp.Checksum, mode git.Mode, encrypt bool) (string, error) {
+	if !encrypt {
+		return path, w.writer.putBlob(path, checksum, mode)
+	}
+	return w.putEncrypted(path, func(dst io.Writer) error {
+		w.ctx.GitEnv.RunStreamRawContent(checksum, dst)
+		return nil
+	})
+}
+
+// putEncrypted stores the encryption of what write writes, and returns where it went.
+func (w *layoutWriter) putEncrypted(path string, write func(io.Writer) error) (string, error) {
+	path += EncryptedSuffix
+	return path, w.writer.putStream(path, func(dst io.Writer) error {
+		return w.ctx.Encryption.encrypt(dst, write)
+	})
+}
+
+func (w *layoutWriter) Finish(manifest Manifest) error {
+	return w.writer.finish(manifest)
+}
+
+func (w *layoutWriter) Location(path string) string {
+	return w.writer.location(path)
+}
+
+// dirWriter writes a change set as a plain directory named after the change set, with <name>.json next to it.
+type dirWriter struct {
+	ctx OutputContext
+}
+
+func (w *dirWriter) begin() error {
+	// TODO: do this properly:
+	return os.Mkdir(w.ctx.ChangeSetDir(), 0755)
+}
+
+func (w *dirWriter) putFile(path string, fsFile *FSFile, _ fp.Checksum, _ bool) error {
+	CopyFile(fsFile.CleanPath, path, w.ctx.ChangeSetDir())
+	return nil
+}
+
+func (w *dirWriter) putBlob(path string, checksum fp.Checksum, mode git.Mode) error {
+	SaveGitBlob(w.ctx.GitEnv, checksum, mode, path, w.ctx.ChangeSetDir())
+	return nil
+}
+
+func (w *dirWriter) putStream(path string, write func(io.Writer) error) error {
+	fp.CreateIntermediateDirectoriesForFile(path, w.ctx.ChangeSetDir())
+	f, err := os.OpenFile(filepath.Join(w.ctx.ChangeSetDir(), path), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buffered := bufio.NewWriter(f)
+	if err = write(buffered); err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (w *dirWriter) finish(manifest Manifest) error {
+	WriteManifest(w.ctx.ManifestFile(), manifest)
+	return nil
+}
+
+func (w *dirWriter) location(path string) string {
+	return filepath.Join(w.ctx.ChangeSetDir(), path)
+}
+
+// storedPerm is the permissions of a file in a change set, given its mode in git. Symlinks are stored as regular files
+// holding their target in every format but tar, and the manifest has their mode. Extracting a tar archive turns them
+// into such files too, so that a change set that is read never holds links.
+func storedPerm(mode git.Mode) os.FileMode {
+	if mode == git.ModeSymlink {
+		return 0644
+	}
+	return mode.FileMode().Perm()
+}
+
+// copyWorktreeContent writes a file as git sees it, so the content of a symlink is its target.
+func copyWorktreeContent(fsFile *FSFile, w io.Writer) error {
+	stat, err := os.Lstat(fsFile.Path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fsFile.Path)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, target)
+		return err
+	}
+	read, err := os.Open(fsFile.Path)
+	if err != nil {
+		return err
+	}
+	defer read.Close()
+	_, err = io.Copy(w, read)
+	return err
+}
+
+// spool writes what write writes to a temporary file, for the formats that need its size or checksum before its
+// content, and calls use with the file at its start. The file is removed afterwards.
+func spool(write func(io.Writer) error, use func(f *os.File, size int64) error) error {
+	f, err := os.CreateTemp("", "orto-spool-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	buffered := bufio.NewWriter(f)
+	if err = write(buffered); err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return use(f, size)
+}
+
+func writeOrDie(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
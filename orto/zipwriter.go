@@ -0,0 +1,111 @@
+package orto
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+// zipWriter writes a change set as a single zip archive. Its contents mirror the directory output: a <name>/
+// directory and a <name>.json manifest, so unzipping it gives a change set that can be restored.
+type zipWriter struct {
+	ctx  OutputContext
+	file *os.File
+	zip  *zip.Writer
+}
+
+func (w *zipWriter) begin() error {
+	// O_EXCL as the destination was checked to not exist
+	f, err := os.OpenFile(w.ctx.DestinationFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.zip = zip.NewWriter(f)
+	return nil
+}
+
+func (w *zipWriter) create(name string, mode os.FileMode, info os.FileInfo) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	}
+	if info != nil {
+		header.Modified = info.ModTime()
+	} else {
+		header.Modified = w.ctx.StartTime
+	}
+	// Sets the unix permissions, including the executable bits, in the external attributes.
+	header.SetMode(mode)
+	return w.zip.CreateHeader(header)
+}
+
+func (w *zipWriter) entryName(relPath string) string {
+	return path.Join(w.ctx.ChangeSetName, filepath.ToSlash(relPath))
+}
+
+func (w *zipWriter) putFile(relPath string, fsFile *FSFile, _ fp.Checksum, _ bool) error {
+	info, err := fsFile.DirEntry.Info()
+	if err != nil {
+		return err
+	}
+	write, err := w.create(w.entryName(relPath), storedPerm(git.ModeOfFileMode(info.Mode())), info)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fsFile.Path)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(write, target)
+		return err
+	}
+	read, err := os.Open(fsFile.Path)
+	if err != nil {
+		return err
+	}
+	defer read.Close()
+	_, err = io.Copy(write, read)
+	return err
+}
+
+func (w *zipWriter) putBlob(relPath string, checksum fp.Checksum, mode git.Mode) error {
+	write, err := w.create(w.entryName(relPath), storedPerm(mode), nil)
+	if err != nil {
+		return err
+	}
+	w.ctx.GitEnv.RunStreamRawContent(checksum, write)
+	return nil
+}
+
+func (w *zipWriter) putStream(relPath string, write func(io.Writer) error) error {
+	dst, err := w.create(w.entryName(relPath), 0600, nil)
+	if err != nil {
+		return err
+	}
+	return write(dst)
+}
+
+func (w *zipWriter) finish(manifest Manifest) error {
+	write, err := w.create(w.ctx.ChangeSetName+".json", 0644, nil)
+	if err != nil {
+		return err
+	}
+	if err = EncodeManifest(write, manifest); err != nil {
+		return err
+	}
+	if err = w.zip.Close(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *zipWriter) location(relPath string) string {
+	return w.ctx.DestinationFile + ":" + w.entryName(relPath)
+}
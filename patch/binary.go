@@ -0,0 +1,73 @@
+package patch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// binaryCheckSize is how much of a file git looks at to decide whether it is binary.
+const binaryCheckSize = 8000
+
+// IsBinary uses git's rule: content with a NUL byte near the start is binary.
+func IsBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), binaryCheckSize)], 0) >= 0
+}
+
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// base85LineSize is the most bytes that git encodes on one line of a binary patch.
+const base85LineSize = 52
+
+// EncodeBase85 encodes data as in git: every 4 bytes, big-endian and zero padded, become 5 characters.
+func EncodeBase85(data []byte) []byte {
+	result := make([]byte, 0, (len(data)+3)/4*5)
+	for i := 0; i < len(data); i += 4 {
+		var acc uint32
+		for j := 0; j < 4; j++ {
+			acc <<= 8
+			if i+j < len(data) {
+				acc |= uint32(data[i+j])
+			}
+		}
+		var group [5]byte
+		for j := 4; j >= 0; j-- {
+			group[j] = base85Alphabet[acc%85]
+			acc /= 85
+		}
+		result = append(result, group[:]...)
+	}
+	return result
+}
+
+// WriteBinaryLiteral writes content as a "literal" hunk of a git binary patch: zlib compressed, then base85 encoded
+// in lines that start with their decoded length.
+func WriteBinaryLiteral(w io.Writer, content []byte) error {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(content); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(bw, "literal %d\n", len(content))
+	data := compressed.Bytes()
+	for len(data) > 0 {
+		n := min(len(data), base85LineSize)
+		if n <= 26 {
+			_ = bw.WriteByte(byte('A' + n - 1))
+		} else {
+			_ = bw.WriteByte(byte('a' + n - 27))
+		}
+		_, _ = bw.Write(EncodeBase85(data[:n]))
+		_ = bw.WriteByte('\n')
+		data = data[n:]
+	}
+	_ = bw.WriteByte('\n')
+	return bw.Flush()
+}
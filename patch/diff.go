@@ -0,0 +1,139 @@
+package patch
+
+import "bytes"
+
+type EditKind int
+
+const (
+	EditEqual EditKind = iota
+	EditDelete
+	EditInsert
+)
+
+// Edit is one line of a diff. Deleted and equal lines are from the old side, inserted lines from the new side.
+type Edit struct {
+	Kind EditKind
+	Line string
+}
+
+// MaxEditCost bounds the work done by Diff. Beyond it, the old lines are replaced wholesale, which is still a correct
+// diff but not a minimal one.
+const MaxEditCost = 4096
+
+// Lines splits content into lines, each keeping its "\n". Only the last line may lack one.
+func Lines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			lines = append(lines, string(content))
+			break
+		}
+		lines = append(lines, string(content[:i+1]))
+		content = content[i+1:]
+	}
+	return lines
+}
+
+// Diff finds the shortest edit script from a to b, using Myers' algorithm.
+func Diff(a []string, b []string) []Edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]Edit, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		edits = append(edits, Edit{Kind: EditEqual, Line: line})
+	}
+	edits = append(edits, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, Edit{Kind: EditEqual, Line: line})
+	}
+	return edits
+}
+
+func myers(a []string, b []string) []Edit {
+	n, m := len(a), len(b)
+	maxD := min(n+m, MaxEditCost)
+	// v[k] is the furthest x reached on diagonal k, offset by maxD+1 so that k-1 and k+1 are always in range.
+	offset := maxD + 1
+	v := make([]int, 2*offset+1)
+	// trace[d] is v as it was before step d, for backtracking. Only diagonals -d..d are kept.
+	var trace [][]int
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return replace(a, b)
+}
+
+func backtrack(a []string, b []string, trace [][]int) []Edit {
+	var reversed []Edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		// trace[d] covers diagonals -d..d
+		v := func(k int) int { return trace[d][k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = v(prevK)
+		}
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, Edit{Kind: EditEqual, Line: a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, Edit{Kind: EditInsert, Line: b[prevY]})
+			} else {
+				reversed = append(reversed, Edit{Kind: EditDelete, Line: a[prevX]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	edits := make([]Edit, 0, len(reversed))
+	for i := len(reversed) - 1; i >= 0; i-- {
+		edits = append(edits, reversed[i])
+	}
+	return edits
+}
+
+func replace(a []string, b []string) []Edit {
+	edits := make([]Edit, 0, len(a)+len(b))
+	for _, line := range a {
+		edits = append(edits, Edit{Kind: EditDelete, Line: line})
+	}
+	for _, line := range b {
+		edits = append(edits, Edit{Kind: EditInsert, Line: line})
+	}
+	return edits
+}
@@ -0,0 +1,143 @@
+package patch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+)
+
+// FilePatch is one file of a git-style patch, that git apply understands. An added file has no OldMode and a
+// deleted one no NewMode.
+type FilePatch struct {
+	Path        string
+	OldMode     git.Mode
+	NewMode     git.Mode
+	OldChecksum fp.Checksum
+	NewChecksum fp.Checksum
+	Old         []byte
+	New         []byte
+}
+
+func (p FilePatch) IsAdded() bool {
+	return p.OldMode == ""
+}
+
+func (p FilePatch) IsDeleted() bool {
+	return p.NewMode == ""
+}
+
+// Write writes the patch for the file: the "diff --git" header, then the hunks, or a binary patch with full
+// contents in both directions if either side is binary.
+func (p FilePatch) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	oldName, newName := QuotePath("a/"+p.Path), QuotePath("b/"+p.Path)
+	_, _ = fmt.Fprintf(bw, "diff --git %s %s\n", oldName, newName)
+	switch {
+	case p.IsAdded():
+		_, _ = fmt.Fprintf(bw, "new file mode %s\n", p.NewMode)
+	case p.IsDeleted():
+		_, _ = fmt.Fprintf(bw, "deleted file mode %s\n", p.OldMode)
+	case p.OldMode != p.NewMode:
+		_, _ = fmt.Fprintf(bw, "old mode %s\nnew mode %s\n", p.OldMode, p.NewMode)
+	}
+
+	oldChecksum, newChecksum := p.OldChecksum, p.NewChecksum
+	if p.IsAdded() {
+		oldChecksum = zeroChecksumLike(newChecksum)
+	}
+	if p.IsDeleted() {
+		newChecksum = zeroChecksumLike(oldChecksum)
+	}
+	if oldChecksum == newChecksum {
+		// Only the mode changed
+		return bw.Flush()
+	}
+	// Full checksums, as git apply needs them for binary patches
+	_, _ = fmt.Fprintf(bw, "index %s..%s", oldChecksum, newChecksum)
+	if !p.IsAdded() && !p.IsDeleted() && p.OldMode == p.NewMode {
+		_, _ = fmt.Fprintf(bw, " %s", p.NewMode)
+	}
+	_, _ = bw.WriteString("\n")
+
+	if IsBinary(p.Old) || IsBinary(p.New) {
+		_, _ = bw.WriteString("GIT binary patch\n")
+		if err := WriteBinaryLiteral(bw, p.New); err != nil {
+			return err
+		}
+		if err := WriteBinaryLiteral(bw, p.Old); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	if len(p.Old) == 0 && len(p.New) == 0 {
+		return bw.Flush()
+	}
+	if p.IsAdded() {
+		oldName = "/dev/null"
+	}
+	if p.IsDeleted() {
+		newName = "/dev/null"
+	}
+	_, _ = fmt.Fprintf(bw, "--- %s\n+++ %s\n", oldName, newName)
+	if err := WriteHunks(bw, Diff(Lines(p.Old), Lines(p.New)), DefaultContext); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func zeroChecksumLike(checksum fp.Checksum) fp.Checksum {
+	return fp.Checksum(strings.Repeat("0", len(checksum)))
+}
+
+// QuotePath quotes a path the way git does when it has control characters, quotes, backslashes or non-ASCII bytes.
+func QuotePath(path string) string {
+	needsQuotes := false
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c < 0x20 || c == '"' || c == '\\' || c >= 0x7f {
+			needsQuotes = true
+			break
+		}
+	}
+	if !needsQuotes {
+		return path
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch c {
+		case '\a':
+			sb.WriteString(`\a`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\v':
+			sb.WriteString(`\v`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				_, _ = fmt.Fprintf(&sb, `\%03o`, c)
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,98 @@
+package patch_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/anknetau/orto/assert"
+	"github.com/anknetau/orto/fp"
+	"github.com/anknetau/orto/git"
+	"github.com/anknetau/orto/patch"
+)
+
+func TestLines(t *testing.T) {
+	assert.Equal(t, 0, len(patch.Lines(nil)))
+	assert.Equal(t, []string{"a\n", "b"}, patch.Lines([]byte("a\nb")))
+	assert.Equal(t, []string{"a\n", "\n"}, patch.Lines([]byte("a\n\n")))
+}
+
+func TestDiff(t *testing.T) {
+	render := func(edits []patch.Edit) string {
+		var sb strings.Builder
+		for _, edit := range edits {
+			sb.WriteString([]string{" ", "-", "+"}[edit.Kind] + strings.TrimSuffix(edit.Line, "\n"))
+		}
+		return sb.String()
+	}
+	split := func(s string) []string {
+		return patch.Lines([]byte(s))
+	}
+	assert.Equal(t, " a b c", render(patch.Diff(split("a\nb\nc\n"), split("a\nb\nc\n"))))
+	assert.Equal(t, " a-b+x c", render(patch.Diff(split("a\nb\nc\n"), split("a\nx\nc\n"))))
+	assert.Equal(t, "+a+b", render(patch.Diff(nil, split("a\nb\n"))))
+	assert.Equal(t, "-a b c+d", render(patch.Diff(split("a\nb\nc\n"), split("b\nc\nd\n"))))
+	// The classic example from Myers' paper has a shortest edit script of 5
+	edits := patch.Diff(split("a\nb\nc\na\nb\nb\na\n"), split("c\nb\na\nb\na\nc\n"))
+	changes := 0
+	for _, edit := range edits {
+		if edit.Kind != patch.EditEqual {
+			changes++
+		}
+	}
+	assert.Equal(t, 5, changes)
+}
+
+func TestWriteHunks(t *testing.T) {
+	var old, new []string
+	for i := 1; i <= 20; i++ {
+		old = append(old, string(rune('a'+i))+"\n")
+	}
+	new = append(new, old...)
+	new[1] = "X\n"
+	new = append(new[:15], new[16:]...)
+	var out bytes.Buffer
+	assert.Equal(t, nil, patch.WriteHunks(&out, patch.Diff(old, new), patch.DefaultContext))
+	assert.Equal(t, "@@ -1,5 +1,5 @@\n b\n-c\n+X\n d\n e\n f\n"+
+		"@@ -13,7 +13,6 @@\n n\n o\n p\n-q\n r\n s\n t\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, nil, patch.WriteHunks(&out, patch.Diff([]string{"a\n", "b"}, []string{"a\n", "b\n"}), patch.DefaultContext))
+	assert.Equal(t, "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n", out.String())
+}
+
+func TestEncodeBase85(t *testing.T) {
+	// zlib's compression of nothing, as in git's "literal 0" hunks
+	assert.Equal(t, "cmV?d00001", string(patch.EncodeBase85([]byte{0x78, 0x01, 0x03, 0x00, 0x00, 0x00, 0x00, 0x01})))
+	assert.Equal(t, "00000", string(patch.EncodeBase85([]byte{0})))
+}
+
+func TestIsBinary(t *testing.T) {
+	assert.False(t, patch.IsBinary([]byte("text\n")))
+	assert.True(t, patch.IsBinary([]byte("te\x00xt")))
+}
+
+func TestQuotePath(t *testing.T) {
+	assert.Equal(t, "a/plain name.txt", patch.QuotePath("a/plain name.txt"))
+	assert.Equal(t, `"a/tab\there"`, patch.QuotePath("a/tab\there"))
+	assert.Equal(t, `"a/\"q\" \\"`, patch.QuotePath(`a/"q" \`))
+	assert.Equal(t, `"a/\303\274"`, patch.QuotePath("a/ü"))
+}
+
+func TestFilePatchDeleted(t *testing.T) {
+	filePatch := patch.FilePatch{
+		Path:        "gone.txt",
+		OldMode:     git.ModeFile,
+		OldChecksum: fp.Checksum("587be6b4c3f93f93c489c0111bba5596147a26cb"),
+		Old:         []byte("x\n"),
+	}
+	var out bytes.Buffer
+	assert.Equal(t, nil, filePatch.Write(&out))
+	assert.Equal(t, "diff --git a/gone.txt b/gone.txt\n"+
+		"deleted file mode 100644\n"+
+		"index 587be6b4c3f93f93c489c0111bba5596147a26cb..0000000000000000000000000000000000000000\n"+
+		"--- a/gone.txt\n"+
+		"+++ /dev/null\n"+
+		"@@ -1 +0,0 @@\n"+
+		"-x\n", out.String())
+}
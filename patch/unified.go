@@ -0,0 +1,75 @@
+package patch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultContext is the number of unchanged lines around each hunk, as in git.
+const DefaultContext = 3
+
+// WriteHunks writes the "@@" hunks of a unified diff for the given edits, with context lines around each change.
+func WriteHunks(w io.Writer, edits []Edit, context int) error {
+	bw := bufio.NewWriter(w)
+	// oldLine and newLine are the number of lines on each side before edits[i]
+	oldLines := make([]int, len(edits)+1)
+	newLines := make([]int, len(edits)+1)
+	for i, edit := range edits {
+		oldLines[i+1], newLines[i+1] = oldLines[i], newLines[i]
+		if edit.Kind != EditInsert {
+			oldLines[i+1]++
+		}
+		if edit.Kind != EditDelete {
+			newLines[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].Kind == EditEqual {
+			i++
+			continue
+		}
+		start := max(0, i-context)
+		// Extend the hunk over changes that are separated by less than two contexts' worth of equal lines
+		end := i
+		for j := i; j < len(edits) && j < end+2*context+1; j++ {
+			if edits[j].Kind != EditEqual {
+				end = j + 1
+			}
+		}
+		end = min(len(edits), end+context)
+
+		oldCount, newCount := oldLines[end]-oldLines[start], newLines[end]-newLines[start]
+		_, _ = fmt.Fprintf(bw, "@@ -%s +%s @@\n", hunkRange(oldLines[start], oldCount), hunkRange(newLines[start], newCount))
+		for _, edit := range edits[start:end] {
+			switch edit.Kind {
+			case EditEqual:
+				_ = bw.WriteByte(' ')
+			case EditDelete:
+				_ = bw.WriteByte('-')
+			case EditInsert:
+				_ = bw.WriteByte('+')
+			}
+			_, _ = bw.WriteString(edit.Line)
+			if !strings.HasSuffix(edit.Line, "\n") {
+				_, _ = bw.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return bw.Flush()
+}
+
+// hunkRange formats one side of a hunk header. Lines are numbered from 1, and an empty range refers to the line
+// before it.
+func hunkRange(before int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}